@@ -0,0 +1,55 @@
+//go:build appengine
+// +build appengine
+
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"appengine"
+	"log"
+	"appengine/urlfetch"
+	"appengine/user"
+	"net/http"
+	"os"
+)
+
+// Hook up datastore, urlfetch, cron/admin checks and router when running on the App Engine
+func init() {
+	Storage = func(r *http.Request) Store {
+		return NewDatastoreStore(appengine.NewContext(r))
+	}
+	HTTPClient = func(r *http.Request) *http.Client {
+		return urlfetch.Client(appengine.NewContext(r))
+	}
+	// Session keys and cookie options from env_variables in app.yaml
+	if config := os.Getenv("AUTOSITE_SESSION_KEYS"); config != "" {
+		keys, err := ParseSessionKeys(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		SessionKeys = keys
+	}
+	SecureCookies = os.Getenv("AUTOSITE_SECURE_COOKIES") == "true"
+	// Master keys for encrypting account secrets
+	if config := os.Getenv("AUTOSITE_MASTER_KEYS"); config != "" {
+		keys, err := ParseMasterKeys(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		MasterKeys = keys
+	}
+	// App Engine strips this header from external requests
+	trustedRequest = func(r *http.Request) bool {
+		return r.Header.Get("X-Appengine-Cron") == "true"
+	}
+	bootstrapRequest = func(r *http.Request) bool {
+		return user.IsAdmin(appengine.NewContext(r))
+	}
+	http.Handle("/", NewRouter())
+}
@@ -0,0 +1,143 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Admin authentication (local users, signed in via session cookie)
+ */
+
+// Session value holding the name of the signed in user
+const sessionUser = "user"
+
+// Let trusted requests through without a signed in user (App Engine swaps in cron and admin checks)
+var trustedRequest = func(r *http.Request) bool {
+	return false
+}
+
+// Let requests through while no users exist yet, so the first one can be created (App Engine swaps in admin check)
+var bootstrapRequest = func(r *http.Request) bool {
+	return false
+}
+
+// Hash to compare against for unknown users, so timing does not reveal which users exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("autosite-go"), bcrypt.DefaultCost)
+
+// Guard handler, only letting signed in users through
+func admin(h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.User == "" && !trustedRequest(r) {
+			n, err := ctx.Store.Count(NewQuery("User"))
+			if err != nil || n > 0 || !bootstrapRequest(r) {
+				if ctx.Method != "GET" {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				http.Redirect(w, r, "/sign_in?return=" + url.QueryEscape(r.URL.RequestURI()), 302)
+				return
+			}
+		}
+		h(w, r, ctx)
+	}
+}
+
+// Create user or change password of existing one
+func SetPassword(s Store, name, password string) error {
+	if name == "" || len(password) < 8 {
+		return errors.New("Name is required and passwords need at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	var users []User
+	keys, err := s.GetAll(NewQuery("User").Filter("Name =", name).Limit(1), &users)
+	if err != nil {
+		return err
+	}
+	user := User{Name: name, Created: time.Now()}
+	key := ""
+	if len(keys) > 0 {
+		user, key = users[0], keys[0]
+	}
+	user.PasswordHash = hash
+	_, err = s.Put("User", key, &user)
+	return err
+}
+
+// Check credentials, returning the user on success
+func Authenticate(s Store, name, password string) (*User, error) {
+	var users []User
+	if _, err := s.GetAll(NewQuery("User").Filter("Name =", name).Limit(1), &users); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errors.New("Unknown user or wrong password")
+	}
+	if bcrypt.CompareHashAndPassword(users[0].PasswordHash, []byte(password)) != nil {
+		return nil, errors.New("Unknown user or wrong password")
+	}
+	return &users[0], nil
+}
+
+// Only allow local paths as return target after signing in
+func returnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/manage"
+	}
+	return path
+}
+
+// Handler: Sign in form and session creation
+func SignInHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	switch ctx.Method {
+		case "POST":
+			user, err := Authenticate(ctx.Store, r.FormValue("Name"), r.FormValue("Password"))
+			if err == nil {
+				// Start over with a fresh session, so nothing planted in the old one (e.g. its anti-forgery token) carries over
+				ctx.Session.Values = map[interface{}]interface{}{sessionUser: user.Name}
+				ctx.Session.Save(r, w)
+				http.Redirect(w, r, returnPath(r.FormValue("return")), 302)
+				return
+			}
+			ctx.Session.AddFlash(err.Error())
+	}
+	render(w, ctx, []string{"manage","sign_in"}, map[string]interface{}{"return": returnPath(r.FormValue("return"))})
+}
+
+// Handler: List, create and delete admin users
+func UsersHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	switch ctx.Method {
+		case "POST":
+			if err := SetPassword(ctx.Store, r.FormValue("Name"), r.FormValue("Password")); err != nil {
+				ctx.Session.AddFlash("An error occured while saving: " + err.Error())
+			} else {
+				ctx.Session.AddFlash("User has been saved successfully")
+			}
+		case "DELETE":
+			var user User
+			key := GetByName(ctx, &user, ctx.Vars["name"])
+			if key != "" && user.Name != ctx.User {
+				Delete(ctx, key)
+			}
+			return
+	}
+	var users []User
+	ctx.Store.GetAll(NewQuery("User").Order("Name"), &users)
+	render(w, ctx, []string{"manage","users"}, map[string]interface{}{"content": &users})
+}
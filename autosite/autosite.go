@@ -9,8 +9,6 @@ package autosite
 
 
 import (
-    "appengine"
-    "appengine/datastore"
     "html/template"
     "net/http"
     "github.com/gorilla/mux"
@@ -19,224 +17,387 @@ import (
     "os"
     "strconv"
     "strings"
+    "time"
 )
 
 
 // Global vars
-var c appengine.Context
 var decoder *schema.Decoder
-var store *sessions.CookieStore
-var session *sessions.Session
-var vars map[string]string
+
+// Request-scoped state, created once per request and handed to every handler
+type Context struct {
+	Store Store
+	Client *http.Client
+	Request *http.Request
+	Session *sessions.Session
+	Vars map[string]string
+	Method string
+	User string
+}
+
+// Handler: Signature of all routes, receiving the request-scoped context
+type Handler func(w http.ResponseWriter, r *http.Request, ctx *Context)
+
+// Set up request context and dispatch to handler
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, err := extendMethod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	h(w, r, ctx)
+}
+
+// Outgoing HTTP client factory, called once per request (App Engine swaps in urlfetch)
+var HTTPClient = func(r *http.Request) *http.Client {
+	return http.DefaultClient
+}
 
 func init() {
-	router := mux.NewRouter()
 	decoder = schema.NewDecoder()
-	store = sessions.NewCookieStore([]byte("what-a-great-secret"))
+	decoder.RegisterConverter(time.Time{}, decodeFormTime)
+}
+
+// Set up router for all admin and visitor routes
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
 	
 	// GET/PUT '/manage'
-	router.HandleFunc("/manage", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/manage", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
 		var site Site
 		var key string
-		switch extendMethod(r) {
+		switch ctx.Method {
 			case "GET":
-				key = Get(&site)
+				key = Get(ctx, &site)
 			case "POST":
 				Build(&site, r)
 				site.TrackerCode = []byte(r.FormValue("TrackerCode"))
-				site.TemplateKey = ToKey(r.FormValue("TemplateKey"))
+				site.TemplateKey = r.FormValue("TemplateKey")
 				if r.FormValue("Key") != "" {
-					key = Update(&site, r.FormValue("Key"))
+					key = Update(ctx, &site, r.FormValue("Key"))
 					break
 				}
-				key = Save(&site)
+				key = Save(ctx, &site)
 		}
-		render(w, []string{"manage","index"}, map[string]interface{}{"key": key, "content": &site})
-	})
+		render(w, ctx, []string{"manage","index"}, map[string]interface{}{"key": key, "content": &site})
+	})))
   
 	// GET/POST/PUT '/manage/networks'
-	router.HandleFunc("/manage/networks", NetworksHandler)
-	router.HandleFunc("/manage/networks/{slug}", NetworksHandler)
+	router.Handle("/manage/networks", admin(Handler(NetworksHandler)))
+	router.Handle("/manage/networks/{slug}", admin(Handler(NetworksHandler)))
+	
+	// GET/POST '/manage/users', DELETE '/manage/users/{name}'
+	router.Handle("/manage/users", admin(Handler(UsersHandler)))
+	router.Handle("/manage/users/{name}", admin(Handler(UsersHandler)))
+	
+	// POST '/manage/sessions'
+	router.Handle("/manage/sessions", admin(Handler(SessionKeysHandler)))
 	
 	// GET '/manage/pages/new'
-	router.HandleFunc("/manage/pages/new", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "GET" {
-			render(w, []string{"manage","pages","new"}, map[string]interface{}{})
+	router.Handle("/manage/pages/new", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "GET" {
+			render(w, ctx, []string{"manage","pages","new"}, map[string]interface{}{})
 		}
-	})
+	})))
 	
 	// POST '/manage/pages/sort'
-	router.HandleFunc("/manage/pages/sort", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "POST" {
+	router.Handle("/manage/pages/sort", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "POST" {
 			r.ParseForm()
-			SortPages(strings.Split(r.Form.Get("order"),","))
+			SortPages(ctx, strings.Split(r.Form.Get("order"),","))
 		}
-	})
+	})))
 	
 	// DELETE '/manage/pages/{slug}'
-	router.HandleFunc("/manage/pages/{slug}", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "DELETE" {
+	router.Handle("/manage/pages/{slug}", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "DELETE" {
 			var page Page
-			key := GetByName(&page, vars["slug"])
-			Delete(key)
+			key := GetByName(ctx, &page, ctx.Vars["slug"])
+			Delete(ctx, key)
+			deletePageRevisions(ctx, key)
 		}
-	})
+	})))
 	
 	// GET '/manage/pages/{slug}/edit'
-	router.HandleFunc("/manage/pages/{slug}/edit", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "GET" {
+	router.Handle("/manage/pages/{slug}/edit", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "GET" {
 			var page Page
-			render(w, []string{"manage","pages","edit"}, map[string]interface{}{"key": GetByName(&page, vars["slug"]), "content": &page})
+			render(w, ctx, []string{"manage","pages","edit"}, map[string]interface{}{"key": GetByName(ctx, &page, ctx.Vars["slug"]), "content": &page})
 		}
-	})
+	})))
+	
+	// GET/POST '/manage/pages/{slug}/revisions'
+	router.Handle("/manage/pages/{slug}/revisions", admin(Handler(RevisionsHandler)))
+	
+	// GET '/manage/posts/new'
+	router.Handle("/manage/posts/new", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "GET" {
+			render(w, ctx, []string{"manage","posts","edit"}, map[string]interface{}{"content": &Post{Timeline: true}})
+		}
+	})))
+	
+	// GET '/manage/posts/{slug}/edit'
+	router.Handle("/manage/posts/{slug}/edit", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "GET" {
+			var post Post
+			render(w, ctx, []string{"manage","posts","edit"}, map[string]interface{}{"key": GetByName(ctx, &post, ctx.Vars["slug"]), "content": &post})
+		}
+	})))
+	
+	// DELETE '/manage/posts/{slug}', GET/POST '/manage/posts'
+	router.Handle("/manage/posts/{slug}", admin(Handler(PostsHandler)))
+	router.Handle("/manage/posts", admin(Handler(PostsHandler)))
 	
 	// GET/POST '/manage/pages'
-	router.HandleFunc("/manage/pages", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/manage/pages", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
 		var page Page
-		method := extendMethod(r)
+		method := ctx.Method
 		if method == "POST" || method == "PUT" {
 			var key string
 			Build(&page, r)
-			page.Body = []byte(r.FormValue("Body"))
+			page.applySchedule(time.Now())
+			if err := page.SetBody(r.FormValue("Body")); err != nil {
+				ctx.Session.AddFlash("Error rendering markdown: " + err.Error())
+				render(w, ctx, []string{"manage","pages","edit"}, map[string]interface{}{"key": r.FormValue("Key"), "content": &page})
+				return
+			}
+			var saved bool
 			switch method {
 				case "POST":
-					pos, _ := Count("Page")
+					pos, _ := Count(ctx, "Page")
 					page.Position = pos + 1
-					key = Save(&page)
+					key = Save(ctx, &page)
+					saved = key != ""
 				case "PUT":
-					key = Update(&page, r.FormValue("Key"))
+					key, saved = updateModel(ctx, &page, r.FormValue("Key"))
 			}
-			render(w, []string{"manage","pages","edit"}, map[string]interface{}{"key": key, "content": &page})
+			if saved {
+				savePageRevision(ctx, key, &page)
+			}
+			render(w, ctx, []string{"manage","pages","edit"}, map[string]interface{}{"key": key, "content": &page})
 			return
 		}
 		pages := make([]Page, 0)
-		q := datastore.NewQuery("Page").Order("Position")
-		q.GetAll(c, &pages)
-		render(w, []string{"manage","pages"}, map[string]interface{}{"content": &pages})
-	})
+		ctx.Store.GetAll(NewQuery("Page").Order("Position"), &pages)
+		render(w, ctx, []string{"manage","pages"}, map[string]interface{}{"content": &pages})
+	})))
+	
+	// GET/POST '/sign_in'
+	router.Handle("/sign_in", Handler(SignInHandler))
 	
-	// GET '/sign_out'
-	router.HandleFunc("/sign_out", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "GET" {
+	// POST '/sign_out' (not GET, so other sites can't sign users out)
+	router.Handle("/sign_out", Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if ctx.Method == "POST" {
+			ctx.Session.Values = map[interface{}]interface{}{}
+			ctx.Session.Save(r, w)
 			cookie, err := r.Cookie("ACSID")
 			if cookie != nil && err == nil {
-				w.Header().Set("Set-Cookie", "ACSID=deleted; Expires=Thu, 01-Jan-1970 00:00:00 GMT; Domain=" + cookie.Domain + "; Path=" + cookie.Path)
+				w.Header().Add("Set-Cookie", "ACSID=deleted; Expires=Thu, 01-Jan-1970 00:00:00 GMT; Domain=" + cookie.Domain + "; Path=" + cookie.Path)
 			}
 		}
 		http.Redirect(w, r, "/", 302)
-	})
+	}))
 	
 	// GET '/auth/twitter'
-	router.HandleFunc("/auth/{provider}", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/auth/{provider}", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if LookupProvider(ctx.Vars["provider"]) == nil {
+			http.NotFound(w, r)
+			return
+		}
 		url := "/"
-		if extendMethod(r) == "GET" {
+		if ctx.Method == "GET" {
 			var account Account
-			key := GetByName(&account, vars["provider"])
-			if key != "" {
+			key := GetByName(ctx, &account, ctx.Vars["provider"])
+			if key != "" && account.Version() == 0 {
+				url = "/manage/networks/" + account.Name
+			} else if key != "" {
 				if account.Version() == 1 {
-					account.prepareOAuthConnection()
-					creds := account.ServeLogin(w, r)
-					Update(&account, key)
-					url = oauthClient.AuthorizationURL(creds, nil)
+					creds := account.ServeLogin(w, r, ctx)
+					Update(ctx, &account, key)
+					url = account.oauthClient().AuthorizationURL(creds, nil)
+				} else if _, ok := account.Provider().(Registrar); ok && account.ConsumerKey == "" {
+					// Registered when the account is saved
+					ctx.Session.AddFlash("Please save " + account.Name + " to register with it before verifying")
+					ctx.Session.Save(r, w)
+					url = "/manage/networks/" + account.Name
 				} else {
-					account.prepareOAuth2Connection(r)
-					url = oauth2Config.AuthCodeURL("")
-					if account.Name == "linkedin" {
-						url = oauth2Config.AuthCodeURL("authentic-autosite-go-request")
-					}
+					url = account.ServeOAuth2Login(w, r, ctx)
 				}
 			}
 		}
 		http.Redirect(w, r, url, 302)
-	})
+	})))
 	
 	// GET '/auth/twitter/callback
-	router.HandleFunc("/auth/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
-		if extendMethod(r) == "GET" {
+	router.Handle("/auth/{provider}/callback", admin(Handler(func(w http.ResponseWriter, r *http.Request, ctx *Context) {
+		if LookupProvider(ctx.Vars["provider"]) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if ctx.Method == "GET" {
 			var account Account
-			key := GetByName(&account, vars["provider"])
+			key := GetByName(ctx, &account, ctx.Vars["provider"])
 			if key != "" {
+				var verified bool
 				if account.Version() == 1 {
-					account.prepareOAuthConnection()
-					account.ServeOAuthCallback(r)
+					verified = account.ServeOAuthCallback(r, ctx)
 				} else {
-					account.prepareOAuth2Connection(r)
-					account.ServeOAuth2Callback(r)
+					verified = account.ServeOAuth2Callback(w, r, ctx)
 				}
-				Update(&account, key)
-				render(w, []string{"manage","networks"}, map[string]interface{}{"key": key, "content": &account})
+				if verified {
+					Update(ctx, &account, key)
+				}
+				render(w, ctx, []string{"manage","networks"}, map[string]interface{}{"key": key, "content": &account})
 			}
 		}
-	})
+	})))
 	
 	// GET '/manage/refresh'
-	router.HandleFunc("/manage/refresh", Refresh)
+	router.Handle("/manage/refresh", admin(Handler(Refresh)))
 	
-	// GET '/'
-	router.HandleFunc("/", RootHandler)
-	router.HandleFunc("/timeline/{page}", RootHandler)
-	router.HandleFunc("/{slug}", RootHandler)
+	// GET '/manage/publish'
+	router.Handle("/manage/publish", admin(Handler(PublishScheduled)))
 	
-	// Hook-up router to go http package
-	http.Handle("/", router)
+	// POST '/hooks/github'
+	router.HandleFunc("/hooks/{provider}", WebhookHandler)
+	
+	// GET '/'
+	router.Handle("/", Handler(RootHandler))
+	router.Handle("/timeline/archive/{year:[0-9]{4}}/{month:[0-9]{1,2}}", Handler(ArchiveHandler))
+	router.Handle("/timeline/{page}", Handler(RootHandler))
+	router.Handle("/feed.{format:atom|rss}", Handler(FeedHandler))
+	router.Handle("/feed/{network}.{format:atom|rss}", Handler(FeedHandler))
+	router.Handle("/blog", Handler(BlogHandler))
+	router.Handle("/blog/page/{page:[0-9]+}", Handler(BlogHandler))
+	router.Handle("/blog/tags/{tag}", Handler(BlogHandler))
+	router.Handle("/blog/tags/{tag}/page/{page:[0-9]+}", Handler(BlogHandler))
+	router.Handle("/blog/{year:[0-9]{4}}", Handler(BlogHandler))
+	router.Handle("/blog/{year:[0-9]{4}}/page/{page:[0-9]+}", Handler(BlogHandler))
+	router.Handle("/blog/{year:[0-9]{4}}/{slug}", Handler(BlogHandler))
+	router.Handle("/{slug}", Handler(RootHandler))
+	return router
 }
 
 // Handler: Deal with all requests related to visitor frontend
-func RootHandler(w http.ResponseWriter, r *http.Request) {
-	if extendMethod(r) == "GET" {
+func RootHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method == "GET" {
 		var site Site
-		Get(&site)
-		if vars["slug"] != "" {
+		Get(ctx, &site)
+		if ctx.Vars["slug"] != "" {
 			var page Page
-			GetByName(&page, vars["slug"])
+			GetByName(ctx, &page, ctx.Vars["slug"])
 			if len(page.Name) > 0 {
+				// Signed in users may preview pages visitors can't see
+				if !page.IsTemplate() && !page.Visible(time.Now()) && ctx.User == "" {
+					http.NotFound(w, r)
+					return
+				}
 				if page.IsTemplate() {
 					css, _ := template.New("css").Parse(page.BodyString())
 					w.Header().Set("Content-Type", "text/css; charset=utf-8")
 					css.Execute(w, nil)
 					return
 				}
-				render(w, []string{"page"}, map[string]interface{}{"site": &site, "page": &page})
+				render(w, ctx, []string{"page"}, map[string]interface{}{"site": &site, "page": &page})
 				return
 			}
 		}
 		current := 1
-		if vars["page"] != "" {
-			temp, _ := strconv.ParseInt(vars["page"], 10, 0)
+		if ctx.Vars["page"] != "" {
+			temp, _ := strconv.ParseInt(ctx.Vars["page"], 10, 0)
 			current = int(temp)
 		}
-		timeline := Timeline(current)
-		render(w, []string{"index"}, map[string]interface{}{"site": &site, "timeline": timeline, "current":current})
+		timeline := Timeline(ctx, current)
+		render(w, ctx, []string{"index"}, map[string]interface{}{"site": &site, "timeline": timeline, "current":current})
 	}
 }
 
 // Handler: Deal with all requests related to networks entity
-func NetworksHandler(w http.ResponseWriter, r *http.Request) {
+func NetworksHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
 		var key string
-		vars = mux.Vars(r)
-		account := Account{Name: "twitter"}
-		if vars["slug"] != "" {
-			account.Name = vars["slug"]
+		account := Account{Name: Providers()[0].Name()}
+		if ctx.Vars["slug"] != "" {
+			account.Name = ctx.Vars["slug"]
+		}
+		if account.Provider() == nil {
+			http.NotFound(w, r)
+			return
 		}
-		switch extendMethod(r) {
+		switch ctx.Method {
 			case "GET":
-				key = GetByName(&account, account.Name)
-				if !account.Verified() {
-					session.AddFlash("Account is currently unverified (authorization expired or was never authorized). Click verify below to fix this.")
+				// Blank form for another account of multi-account providers
+				if r.FormValue("new") == "" || !account.MultiAccount() {
+					key = GetByName(ctx, &account, account.Name)
+				}
+				account.SetDefaults()
+				if !account.Verified() && account.Version() > 0 {
+					ctx.Session.AddFlash("Account is currently unverified (authorization expired or was never authorized). Click verify below to fix this.")
 				}
 			case "PUT":
+				var stored Account
+				GetByKey(ctx, &stored, r.FormValue("Key"))
 				Build(&account, r)
-				key = Update(&account, r.FormValue("Key"))
+				// Secrets are never sent to the form, so keep the stored ones unless replaced
+				keepSecrets(&account, &stored)
+				account.Expires = stored.Expires
+				account.LatestId, account.LatestGuid, account.LatestCreated, account.LatestUser = stored.LatestId, stored.LatestGuid, stored.LatestCreated, stored.LatestUser
+				key = r.FormValue("Key")
+				if err := account.checkRetention(); err != nil {
+					ctx.Session.AddFlash(err.Error())
+				} else if register(ctx, &account) {
+					key = Update(ctx, &account, key)
+				}
 			case "POST":
 				Build(&account, r)
-				key = Save(&account)
+				if instance := slugify(r.FormValue("Instance")); instance != "" && account.MultiAccount() {
+					account.Name = account.Provider().Name() + "-" + instance
+				}
+				if err := account.checkRetention(); err != nil {
+					ctx.Session.AddFlash(err.Error())
+				} else if accountKey(ctx, account.Name) != "" {
+					ctx.Session.AddFlash("Please pick an instance name that is not taken by another account")
+				} else if register(ctx, &account) {
+					key = Save(ctx, &account)
+				}
+		}
+		var instances []string
+		if account.MultiAccount() {
+			var accounts []Account
+			ctx.Store.GetAll(NewQuery("Account").Order("Name"), &accounts)
+			for i := range accounts {
+				if accounts[i].Provider() == account.Provider() {
+					instances = append(instances, accounts[i].Name)
+				}
+			}
 		}
-		render(w, []string{"manage","networks"}, map[string]interface{}{"key": key, "content": &account})
+		render(w, ctx, []string{"manage","networks"}, map[string]interface{}{"key": key, "content": &account, "instances": instances})
+}
+
+// Register with networks clients need to register with before authorizing (e.g. Mastodon instances), reporting whether the account can be saved
+func register(ctx *Context, account *Account) bool {
+	registrar, ok := account.Provider().(Registrar)
+	if !ok {
+		return true
+	}
+	if err := registrar.Register(ctx, account); err != nil {
+		ctx.Session.AddFlash("Error registering with " + account.Name + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// Key of the account with given name, if any
+func accountKey(ctx *Context, name string) string {
+	keys, _ := ctx.Store.GetAll(NewQuery("Account").Filter("Name =", name).Limit(1), nil)
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
 }
 
 // Helper: Parses and returns template files for given url pattern
-func render(w http.ResponseWriter, url []string, pageData map[string]interface{})  {
-	if flashes := session.Flashes(); len(flashes) > 0 {
+func render(w http.ResponseWriter, ctx *Context, url []string, pageData map[string]interface{})  {
+	if flashes := ctx.Session.Flashes(); len(flashes) > 0 {
 		pageData["notice"] = flashes
     }
     layout := "templates/" + url[0] + "/base.html"
@@ -245,40 +406,53 @@ func render(w http.ResponseWriter, url []string, pageData map[string]interface{}
     }
     funcMap := template.FuncMap {
 		"formatTime": formatTime,
+		"blog": func() bool { n, _ := ctx.Store.Count(NewQuery("Post").Filter("Draft =", false)); return n > 0 },
+		"formTime": formTime,
 		"htmlSafe": htmlSafe,
-		"navigation": navigation,
-		"pagination": pagination,
+		"navigation": func() []map[string]string { return navigation(ctx) },
+		"pagination": func(current int) template.HTML { return pagination(ctx, current) },
+		"posters": Posters,
+		"providers": Providers,
+	}
+    pageData["ctx"] = ctx
+    if url[0] == "manage" {
+		pageData["csrf"] = csrfToken(w, ctx)
 	}
     pageTemplate, _ := template.New("website").Funcs(funcMap).ParseFiles(layout, "templates/" + strings.Join(url,"/") + ".html")
 	pageTemplate.Execute(w, pageData)	
 }
 
-// Helper: Use _method form field to support PUT and DELETE requests just like the regular GET and POST (-> RESTful routes)
-func extendMethod(r *http.Request) string {
-	c = appengine.NewContext(r)
-	session, _ = store.Get(r, "autosite-go-session")
-	vars = mux.Vars(r)
+// Helper: Use _method form field to support PUT and DELETE requests just like the regular GET and POST (-> RESTful routes),
+// verifying the anti-forgery token of all of them but GET
+func extendMethod(r *http.Request) (*Context, error) {
+	ctx := &Context{Store: sealedStore{Storage(r)}, Client: HTTPClient(r), Request: r, Vars: mux.Vars(r), Method: r.Method}
+	ctx.Session, _ = sessionStore(ctx.Store).Get(r, sessionName)
+	if name, ok := ctx.Session.Values[sessionUser].(string); ok {
+		ctx.User = name
+	}
 	if r.Method == "POST" && (strings.ToUpper(r.FormValue("_method")) == "PUT" || strings.ToUpper(r.FormValue("_method")) == "DELETE")  {
-		return strings.ToUpper(r.FormValue("_method"))
+		ctx.Method = strings.ToUpper(r.FormValue("_method"))
 	}
-	return r.Method
+	switch ctx.Method {
+		case "POST", "PUT", "DELETE":
+			if err := verifyCSRFToken(ctx); err != nil {
+				return nil, err
+			}
+	}
+	return ctx, nil
 }
 
 // Helper: Render navigation
-func navigation() []map[string]string {
+func navigation(ctx *Context) []map[string]string {
 	var pages []map[string]string
-	q := datastore.NewQuery("Page").Filter("Published = ", true).Order("Position")
-	for t := q.Run(c); ; {
-		var page Page
-		_, err := t.Next(&page)
-		if err == datastore.Done {
-			break
-        }
-        if err != nil {
-			session.AddFlash("An error occured while loading: %s", err.Error())
-			break
-        }
-        if !page.IsTemplate() {
+	var published []Page
+	q := NewQuery("Page").Order("Position")
+	if _, err := ctx.Store.GetAll(q, &published); err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+	}
+	now := time.Now()
+	for _, page := range published {
+		if !page.IsTemplate() && page.Visible(now) {
 			pages = append(pages, map[string]string{"Name": page.Name, "Title": page.Title})
 		}
 	}
@@ -286,9 +460,9 @@ func navigation() []map[string]string {
 }
 
 // Helper: Render pagination widget
-func pagination(current int) template.HTML {
+func pagination(ctx *Context, current int) template.HTML {
 	var snippet string
-	n, _ := Count("Status")
+	n, _ := Count(ctx, "Status")
 	for i := 1; i <= (n / 9); i++ {
 		var temp string
 		index := strconv.FormatInt(int64(i), 10)
@@ -8,8 +8,8 @@
 package autosite
 
 import (
-	"appengine/urlfetch"
     "encoding/json"
+    "errors"
     "fmt"
     "io/ioutil"
 	"github.com/garyburd/go-oauth/oauth"
@@ -26,13 +26,10 @@ import (
 /*
  * OAuth Client
  */
- 
-// Global vars
-var oauthClient oauth.Client
 
 // Authorize
-func (a *Account) ServeLogin(w http.ResponseWriter, r *http.Request) *oauth.Credentials {
-	tempCred, err := oauthClient.RequestTemporaryCredentials(urlfetch.Client(c), "http://" + r.Host + "/auth/" + a.Name + "/callback", nil)
+func (a *Account) ServeLogin(w http.ResponseWriter, r *http.Request, ctx *Context) *oauth.Credentials {
+	tempCred, err := a.oauthClient().RequestTemporaryCredentials(ctx.Client, "http://" + r.Host + "/auth/" + a.Name + "/callback", nil)
 	if err != nil {
 		log.Printf("Error during " + a.Name + " authentication: %s", err.Error())
 		return nil
@@ -43,21 +40,21 @@ func (a *Account) ServeLogin(w http.ResponseWriter, r *http.Request) *oauth.Cred
 }
 
 // Authorize Callback
-func (a *Account) ServeOAuthCallback(r *http.Request) {
+func (a *Account) ServeOAuthCallback(r *http.Request, ctx *Context) bool {
 	tempCred := oauth.Credentials{Token: r.FormValue("oauth_token"), Secret: a.Secret}
-	tokenCred, _, err := oauthClient.RequestToken(urlfetch.Client(c), &tempCred, r.FormValue("oauth_verifier"))
+	tokenCred, _, err := a.oauthClient().RequestToken(ctx.Client, &tempCred, r.FormValue("oauth_verifier"))
 	if err != nil {
-		session.AddFlash("Error during " + a.Name + " authentication: " + err.Error())
-		return
+		ctx.Session.AddFlash("Error during " + a.Name + " authentication: " + err.Error())
+		return false
 	}
 	a.Token = tokenCred.Token
 	a.Secret = tokenCred.Secret
+	return true
 }
 
 // apiGet issues a GET request to the API and decodes the response JSON to data.
-func (a *Account) apiGet(urlStr string, form url.Values, data interface{}) error {
-	a.prepareOAuthConnection()
-	resp, err := oauthClient.Get(urlfetch.Client(c), &oauth.Credentials{Token: a.Token, Secret: a.Secret}, urlStr, form)
+func (a *Account) apiGet(ctx *Context, urlStr string, form url.Values, data interface{}) error {
+	resp, err := a.oauthClient().Get(ctx.Client, &oauth.Credentials{Token: a.Token, Secret: a.Secret}, urlStr, form)
 	if err != nil {
 		return err
 	}
@@ -66,9 +63,8 @@ func (a *Account) apiGet(urlStr string, form url.Values, data interface{}) error
 }
 
 // apiPost issues a POST request to the API and decodes the response JSON to data.
-func (a *Account) apiPost(urlStr string, form url.Values) (string, error) {
-	a.prepareOAuthConnection()
-	resp, err := oauthClient.Post(urlfetch.Client(c), &oauth.Credentials{Token: a.Token, Secret: a.Secret}, urlStr, form)
+func (a *Account) apiPost(ctx *Context, urlStr string, form url.Values) (string, error) {
+	resp, err := a.oauthClient().Post(ctx.Client, &oauth.Credentials{Token: a.Token, Secret: a.Secret}, urlStr, form)
 	if err != nil {
 		return "", err
 	}
@@ -86,8 +82,8 @@ func decodeResponse(resp *http.Response, data interface{}) error {
 }
 
 // OAuth settings
-func (a * Account) prepareOAuthConnection() {
-	oauthClient = oauth.Client{
+func (a *Account) oauthClient() *oauth.Client {
+	return &oauth.Client{
 		TemporaryCredentialRequestURI: a.RequestUrl,
 		ResourceOwnerAuthorizationURI: a.AuthUrl,
 		TokenRequestURI:               a.AccessUrl,
@@ -100,40 +96,95 @@ func (a * Account) prepareOAuthConnection() {
  * Twitter Client
  */
  
+type twitterProvider struct{}
+
+func (twitterProvider) Name() string { return "twitter" }
+func (twitterProvider) Title() string { return "Twitter" }
+func (twitterProvider) Version() int { return 1 }
+
+func (twitterProvider) Defaults() Account {
+	return Account{RequestUrl: "https://api.twitter.com/oauth/request_token", AuthUrl: "https://api.twitter.com/oauth/authorize", AccessUrl: "https://api.twitter.com/oauth/access_token"}
+}
+
+func (twitterProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetTwitterUpdates(ctx)
+}
+
+func (twitterProvider) PostUpdates(ctx *Context, a *Account, posts []map[string]string) {
+	a.PostTwitterUpdate(ctx, posts)
+}
+
+// API base URL (swapped for a local server in tests)
+var twitterAPI = "https://api.twitter.com/1.1"
+
+type twitterStatus struct {
+	IdStr flexString `json:"id_str"`
+	Text string `json:"text"`
+	Source string `json:"source"`
+	CreatedAt string `json:"created_at"`
+	User struct {
+		ScreenName string `json:"screen_name"`
+	} `json:"user"`
+}
 
 // Get Updates from Twitter
-func (a *Account) GetTwitterUpdates(r *http.Request) {
-	var timeline []map[string]interface{}
+func (a *Account) GetTwitterUpdates(ctx *Context) {
+	var body json.RawMessage
 	params := url.Values{}
-	srcmatch, _ := regexp.Compile("Autosite</a>$")
-	if latest := Latest("twitter"); latest.OriginalId > 0 {
+	if latest := a.Latest(ctx); latest.OriginalId > 0 {
 		params.Add("since_id", strconv.FormatInt(latest.OriginalId, 10))
 	}
-	if err := a.apiGet("https://api.twitter.com/1.1/statuses/user_timeline.json", params, &timeline); err != nil {
-		session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+	if err := a.apiGet(ctx, twitterAPI + "/statuses/user_timeline.json", params, &body); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	updates, err := parseTwitterTimeline(body)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
 		return
 	}
-	for i := 0; i < len(timeline); i++ {
-		if srcmatch.FindString(timeline[i]["source"].(string)) == "" {
-			created_at, _ := time.Parse("Mon Jan 2 15:04:05 -0700 2006", timeline[i]["created_at"].(string))
-			urlextractor, _ := regexp.Compile(" http://[a-zA-Z0-9\\./-]*")
-			id, _ := strconv.ParseInt(timeline[i]["id_str"].(string), 10, 64)
-			update := Status {
-				Name: "twitter",
-				OriginalId: id,
-				Heading: urlextractor.ReplaceAllString(timeline[i]["text"].(string),""),
-				Link: strings.TrimLeft(urlextractor.FindString(timeline[i]["text"].(string)), " "),
-				Created: created_at,
-				User: timeline[i]["user"].(map[string]interface {})["screen_name"].(string), 
-				UserUrl: "https://twitter.com/" + timeline[i]["user"].(map[string]interface {})["screen_name"].(string),
-			}
-			Save(&update)
+	a.saveStatuses(ctx, updates, time.Time{})
+}
+
+// Parse user timeline, leaving out updates posted by Autosite itself
+func parseTwitterTimeline(data []byte) ([]parsedStatus, error) {
+	items, err := decodeItems(data)
+	if err != nil {
+		return nil, err
+	}
+	srcmatch, _ := regexp.Compile("Autosite</a>$")
+	urlextractor, _ := regexp.Compile(" http://[a-zA-Z0-9\\./-]*")
+	var updates []parsedStatus
+	for _, item := range items {
+		var tweet twitterStatus
+		if err := json.Unmarshal(item, &tweet); err != nil {
+			skipMalformed("twitter", err)
+			continue
 		}
-    }
+		if srcmatch.FindString(tweet.Source) != "" {
+			continue
+		}
+		created_at, err := time.Parse("Mon Jan 2 15:04:05 -0700 2006", tweet.CreatedAt)
+		if err != nil {
+			skipMalformed("twitter", err)
+			continue
+		}
+		id, _ := strconv.ParseInt(string(tweet.IdStr), 10, 64)
+		updates = append(updates, parsedStatus{Status: Status {
+			Name: "twitter",
+			OriginalId: id,
+			Heading: urlextractor.ReplaceAllString(tweet.Text, ""),
+			Link: strings.TrimLeft(urlextractor.FindString(tweet.Text), " "),
+			Created: created_at,
+			User: tweet.User.ScreenName,
+			UserUrl: "https://twitter.com/" + tweet.User.ScreenName,
+		}})
+	}
+	return updates, nil
 }
 
 // Post updates to Twitter
-func (a *Account) PostTwitterUpdate(posts []map[string]string) {
+func (a *Account) PostTwitterUpdate(ctx *Context, posts []map[string]string) {
 	for i := 1; i <= len(posts); i++ {
 		tweet := posts[len(posts) - i]["status"] 
 		if len(tweet) > 119 {
@@ -142,11 +193,11 @@ func (a *Account) PostTwitterUpdate(posts []map[string]string) {
 		if val,ok := posts[len(posts) - i]["link"]; ok {
 			tweet += " " + val
 		}
-		msg, err := a.apiPost("https://api.twitter.com/1.1/statuses/update.json", url.Values{"status": {tweet}})
+		msg, err := a.apiPost(ctx, twitterAPI + "/statuses/update.json", url.Values{"status": {tweet}})
 		if err != nil {
-			session.AddFlash("Error posting " + a.Name + " update: " + err.Error())
+			ctx.Session.AddFlash("Error posting " + a.Name + " update: " + err.Error())
 		}
-		session.AddFlash("Response posting " + a.Name + " update '" +  tweet + "': " + msg)
+		ctx.Session.AddFlash("Response posting " + a.Name + " update '" +  tweet + "': " + msg)
 	}
 }
 
@@ -155,67 +206,113 @@ func (a *Account) PostTwitterUpdate(posts []map[string]string) {
  * XING Client
  */
  
+type xingProvider struct{}
+
+func (xingProvider) Name() string { return "xing" }
+func (xingProvider) Title() string { return "XING" }
+func (xingProvider) Version() int { return 1 }
+
+func (xingProvider) Defaults() Account {
+	return Account{RequestUrl: "https://api.xing.com/v1/request_token", AuthUrl: "https://api.xing.com/v1/authorize", AccessUrl: "https://api.xing.com/v1/access_token"}
+}
+
+func (xingProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetXingUpdates(ctx)
+}
+
+type xingFeed struct {
+	NetworkActivities []json.RawMessage `json:"network_activities"`
+}
+
+type xingActivity struct {
+	Verb string `json:"verb"`
+	CreatedAt time.Time `json:"created_at"`
+	Actors []struct {
+		DisplayName string `json:"display_name"`
+		Permalink string `json:"permalink"`
+	} `json:"actors"`
+	Objects []struct {
+		Type string `json:"type"`
+		Content string `json:"content"`
+		Name string `json:"name"`
+		Title string `json:"title"`
+		Permalink string `json:"permalink"`
+		Url string `json:"url"`
+	} `json:"objects"`
+}
 
 // Get Updates from XING
-func (a *Account) GetXingUpdates(r *http.Request) {
-	
-	// Sets vars
-	var data map[string]interface{}
-	var tweets []map[string]string
-	
-	// Fire request
+func (a *Account) GetXingUpdates(ctx *Context) {
+	var body json.RawMessage
 	params := url.Values{"user_fields": {"display_name,permalink"}}
-	if latest := Latest("xing"); latest.OriginalId > 0 {
+	if latest := a.Latest(ctx); latest.OriginalId > 0 {
 		params.Add("since", latest.Created.Format("2006-01-02T15:04:05Z"))
 	}
-	if err := a.apiGet("https://api.xing.com/v1/users/me/feed", params, &data); err != nil {
-		session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+	if err := a.apiGet(ctx, "https://api.xing.com/v1/users/me/feed", params, &body); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
 		return
 	}
-	
-	// Iterate through updates
-	for i := 0; i < len(data["network_activities"].([]interface{})); i++ {
-		activity := data["network_activities"].([]interface{})[i].(map[string]interface{})
-		if activity["verb"].(string) == "post" {
-			created_at, _ := time.Parse("2006-01-02T15:04:05Z", activity["created_at"].(string))
-			update := Status {
-				Name: "xing",
-				OriginalId: created_at.Unix(),
-				Created: created_at,
-				User: activity["actors"].([]interface{})[0].(map[string]interface{})["display_name"].(string),
-				UserUrl: activity["actors"].([]interface{})[0].(map[string]interface{})["permalink"].(string),
-			}
-			switch (activity["objects"].([]interface{})[0].(map[string]interface{})["type"].(string)) {
-				case "status":
-					update.Heading = activity["objects"].([]interface{})[0].(map[string]interface{})["content"].(string)
-					tweets = append(tweets, map[string]string{"status": update.Heading})
-				case "event":
-					update.Heading = "posted an event"
-					update.Content = activity["objects"].([]interface{})[0].(map[string]interface{})["name"].(string)
-					update.Link = activity["objects"].([]interface{})[0].(map[string]interface{})["permalink"].(string)
-					tweets = append(tweets, map[string]string{"status": "I " + update.Heading + ": " + update.Content, "link": update.Link})
-				case "job_posting":
-					update.Heading = "posted a job"
-					update.Content = activity["objects"].([]interface{})[0].(map[string]interface{})["name"].(string)
-					update.Link = activity["objects"].([]interface{})[0].(map[string]interface{})["permalink"].(string)
-					tweets = append(tweets, map[string]string{"status": "I " + update.Heading + ": " + update.Content, "link": update.Link})
-				case "thread":
-					update.Heading = "posted to the thread"
-					update.Content = activity["objects"].([]interface{})[0].(map[string]interface{})["title"].(string)
-					update.Link = activity["objects"].([]interface{})[0].(map[string]interface{})["permalink"].(string)
-					tweets = append(tweets, map[string]string{"status": "I " + update.Heading + ": " + update.Content, "link": update.Link})
-				case "bookmark":
-					update.Heading = "shared a bookmark"
-					update.Content = activity["objects"].([]interface{})[0].(map[string]interface{})["title"].(string)
-					update.Link = activity["objects"].([]interface{})[0].(map[string]interface{})["url"].(string)
-					tweets = append(tweets, map[string]string{"status": "I " + update.Heading + ": " + update.Content, "link": update.Link})
-			}
-			Save(&update)
-		}
+	updates, err := parseXingFeed(body)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	a.saveStatuses(ctx, updates, time.Time{})
+}
+
+// Parse network feed, keeping the user's own posts
+func parseXingFeed(data []byte) ([]parsedStatus, error) {
+	var feed xingFeed
+	if err := json.Unmarshal(data, &feed); err != nil {
+		return nil, err
 	}
-	if a.Repost && len(tweets) > 0 {
-		var twitter Account
-		GetByName(&twitter, "twitter")
-		twitter.PostTwitterUpdate(tweets)
+	var updates []parsedStatus
+	for _, item := range feed.NetworkActivities {
+		var activity xingActivity
+		if err := json.Unmarshal(item, &activity); err != nil {
+			skipMalformed("xing", err)
+			continue
+		}
+		if activity.Verb != "post" {
+			continue
+		}
+		if len(activity.Actors) == 0 || len(activity.Objects) == 0 {
+			skipMalformed("xing", errors.New("activity without actor or object"))
+			continue
+		}
+		actor, object := activity.Actors[0], activity.Objects[0]
+		update := parsedStatus{Status: Status {
+			Name: "xing",
+			OriginalId: activity.CreatedAt.Unix(),
+			Created: activity.CreatedAt,
+			User: actor.DisplayName,
+			UserUrl: actor.Permalink,
+		}}
+		switch (object.Type) {
+			case "status":
+				update.Heading = object.Content
+				update.Repost = map[string]string{"status": update.Heading}
+			case "event":
+				update.Heading = "posted an event"
+				update.Content = object.Name
+				update.Link = object.Permalink
+			case "job_posting":
+				update.Heading = "posted a job"
+				update.Content = object.Name
+				update.Link = object.Permalink
+			case "thread":
+				update.Heading = "posted to the thread"
+				update.Content = object.Title
+				update.Link = object.Permalink
+			case "bookmark":
+				update.Heading = "shared a bookmark"
+				update.Content = object.Title
+				update.Link = object.Url
+		}
+		if update.Repost == nil && update.Heading != "" {
+			update.Repost = map[string]string{"status": "I " + update.Heading + ": " + update.Content, "link": update.Link}
+		}
+		updates = append(updates, update)
 	}
+	return updates, nil
 }
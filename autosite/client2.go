@@ -8,9 +8,16 @@
 package autosite
 
 import (
-	"appengine/urlfetch"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/paceline/goauth2/oauth"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -20,25 +27,121 @@ import (
  * OAuth2 Client
  */
 
-// Global vars
-var oauth2Config *oauth.Config
+// Session values holding the state (and PKCE code verifier) of the pending authorization request
+const sessionOAuth2State = "oauth2_state"
+const sessionOAuth2Verifier = "oauth2_verifier"
+
+// Authorize, returning the URL to redirect to (with a random state kept in the session until the callback)
+func (a *Account) ServeOAuth2Login(w http.ResponseWriter, r *http.Request, ctx *Context) string {
+	state := base64.RawURLEncoding.EncodeToString(randomKey(24))
+	ctx.Session.Values[sessionOAuth2State] = a.Name + ":" + state
+	authURL := a.oauth2Config(r).AuthCodeURL(state)
+	if a.PKCE {
+		verifier := base64.RawURLEncoding.EncodeToString(randomKey(32))
+		challenge := sha256.Sum256([]byte(verifier))
+		ctx.Session.Values[sessionOAuth2Verifier] = verifier
+		authURL += "&" + url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(challenge[:])}, "code_challenge_method": {"S256"}}.Encode()
+	}
+	ctx.Session.Save(r, w)
+	return authURL
+}
 
 // Authorize Callback
-func (a *Account) ServeOAuth2Callback(r *http.Request) {
+func (a *Account) ServeOAuth2Callback(w http.ResponseWriter, r *http.Request, ctx *Context) bool {
+	expected, _ := ctx.Session.Values[sessionOAuth2State].(string)
+	verifier, _ := ctx.Session.Values[sessionOAuth2Verifier].(string)
+	delete(ctx.Session.Values, sessionOAuth2State)
+	delete(ctx.Session.Values, sessionOAuth2Verifier)
+	ctx.Session.Save(r, w)
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(a.Name + ":" + r.FormValue("state"))) != 1 {
+		ctx.Session.AddFlash("Error during " + a.Name + " authentication: Authorization request could not be verified, please try again")
+		return false
+	}
 	code := r.FormValue("code")
-	t := oauth.Transport{Config: oauth2Config, Transport: &urlfetch.Transport{Context: c}}
-	tokenCred, err := t.Exchange(code)
+	var tokenCred *oauth.Token
+	var err error
+	if a.PKCE {
+		tokenCred, err = a.exchangeWithVerifier(ctx, code, verifier)
+	} else {
+		t := oauth.Transport{Config: a.oauth2Config(r), Transport: ctx.Client.Transport}
+		tokenCred, err = t.Exchange(code)
+	}
 	if err != nil {
-		session.AddFlash("Error during " + a.Name + " authentication: " + err.Error())
-		return
+		ctx.Session.AddFlash("Error during " + a.Name + " authentication: " + err.Error())
+		return false
 	}
 	a.Token = tokenCred.AccessToken
 	a.Expires = tokenCred.Expiry
+	if tokenCred.RefreshToken != "" {
+		a.RefreshToken = tokenCred.RefreshToken
+	}
+	return true
+}
+
+// Exchange authorization code for token, proving possession of the PKCE code verifier
+func (a *Account) exchangeWithVerifier(ctx *Context, code string, verifier string) (*oauth.Token, error) {
+	if verifier == "" {
+		return nil, fmt.Errorf("PKCE code verifier missing, please try again")
+	}
+	config := a.oauth2Config(ctx.Request)
+	form := url.Values{
+		"grant_type": {"authorization_code"},
+		"code": {code},
+		"redirect_uri": {config.RedirectURL},
+		"client_id": {config.ClientId},
+		"code_verifier": {verifier},
+	}
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	req, _ := http.NewRequest("POST", config.TokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		p, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Token request returned status %d, %s", resp.StatusCode, p)
+	}
+	var data struct {
+		AccessToken string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn int64 `json:"expires_in"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.AccessToken == "" {
+		return nil, fmt.Errorf("Token request failed: %s", data.Error)
+	}
+	token := &oauth.Token{AccessToken: data.AccessToken, RefreshToken: data.RefreshToken}
+	if data.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(data.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// Exchange refresh token for a new access token
+func (a *Account) renewOAuth2Token(ctx *Context) error {
+	t := oauth.Transport{Config: a.oauth2Config(ctx.Request), Token: &oauth.Token{RefreshToken: a.RefreshToken}, Transport: ctx.Client.Transport}
+	if err := t.Refresh(); err != nil {
+		return err
+	}
+	a.Token = t.Token.AccessToken
+	a.Expires = t.Token.Expiry
+	if t.Token.RefreshToken != "" {
+		a.RefreshToken = t.Token.RefreshToken
+	}
+	return nil
 }
 
 // OAuth2 settings
-func (a *Account) prepareOAuth2Connection(r *http.Request) {
-	oauth2Config = &oauth.Config {
+func (a *Account) oauth2Config(r *http.Request) *oauth.Config {
+	return &oauth.Config {
 		ClientId: a.ConsumerKey,
         ClientSecret: a.ConsumerSecret,
         AuthURL: a.AuthUrl,
@@ -53,14 +156,85 @@ func (a *Account) prepareOAuth2Connection(r *http.Request) {
  * GitHub Client
  */
  
+type githubProvider struct{}
+
+func (githubProvider) Name() string { return "github" }
+func (githubProvider) Title() string { return "Github" }
+func (githubProvider) Version() int { return 2 }
+
+func (githubProvider) Defaults() Account {
+	return Account{AuthUrl: "https://github.com/login/oauth/authorize", AccessUrl: "https://github.com/login/oauth/access_token"}
+}
+
+func (githubProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetGithubUpdates(ctx)
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+	HtmlUrl string `json:"html_url"`
+}
+
+// Event as listed by the events API (webhook deliveries are wrapped into one)
+type githubEvent struct {
+	Id flexString `json:"id"`
+	Type string `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Repo struct {
+		Name string `json:"name"`
+	} `json:"repo"`
+	Payload githubPayload `json:"payload"`
+}
+
+type githubPayload struct {
+	Action string `json:"action"`
+	Ref flexString `json:"ref"`
+	RefType string `json:"ref_type"`
+	Head flexString `json:"head"`
+	Comment struct {
+		Body string `json:"body"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"comment"`
+	Download struct {
+		Name string `json:"name"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"download"`
+	Target githubUser `json:"target"`
+	Gist struct {
+		Description string `json:"description"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"gist"`
+	Pages []struct {
+		Action string `json:"action"`
+		PageName string `json:"page_name"`
+		HtmlUrl string `json:"html_url"`
+		Sha string `json:"sha"`
+	} `json:"pages"`
+	Issue struct {
+		Number flexInt `json:"number"`
+		Body string `json:"body"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"issue"`
+	Member githubUser `json:"member"`
+	PullRequest struct {
+		Title string `json:"title"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"pull_request"`
+	Commits []struct {
+		Message string `json:"message"`
+	} `json:"commits"`
+	User githubUser `json:"user"`
+	Team struct {
+		Name string `json:"name"`
+	} `json:"team"`
+}
 
 // Get Updates from GitHub
-func (a *Account) GetGithubUpdates(r *http.Request) {
+func (a *Account) GetGithubUpdates(ctx *Context) {
 	
 	// Initialize connection
-	var tweets []map[string]string
-	t := oauth.Transport{Config: oauth2Config, Token: &oauth.Token{AccessToken: a.Token}, Transport: &urlfetch.Transport{Context: c}}
-	latest := Latest("github")
+	t := oauth.Transport{Config: a.oauth2Config(ctx.Request), Token: &oauth.Token{AccessToken: a.Token}, Transport: ctx.Client.Transport}
+	latest := a.Latest(ctx)
 	login := latest.User
 	
 	// Get authenticated user
@@ -70,14 +244,15 @@ func (a *Account) GetGithubUpdates(r *http.Request) {
 	}
 	resp, err := t.Client().Do(req)
 	if err != nil {
-		session.AddFlash("Error getting " + a.Name + " user info: " + err.Error())
+		ctx.Session.AddFlash("Error getting " + a.Name + " user info: " + err.Error())
 		return
 	}
 	if resp.StatusCode == 200 {
-		var user map[string]interface{}
+		var user githubUser
 		defer resp.Body.Close()
-		decodeResponse(resp, &user)
-		login = user["login"].(string)
+		if err := decodeResponse(resp, &user); err == nil && user.Login != "" {
+			login = user.Login
+		}
 	}
 	
 	// Fire request and save timeline
@@ -87,158 +262,254 @@ func (a *Account) GetGithubUpdates(r *http.Request) {
 	}
 	resp, err = t.Client().Do(req)
 	if err != nil {
-		session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
 		return
 	}
 	if resp.StatusCode == 200 {
 		defer resp.Body.Close()
-		var timeline []map[string]interface{}
-		decodeResponse(resp, &timeline)
-		for i := 0; i < len(timeline); i++ {
-			created_at, _ := time.Parse("2006-01-02T15:04:05Z", timeline[i]["created_at"].(string))
-			if created_at.After(latest.Created) {  
-				id, _ := strconv.ParseInt(timeline[i]["id"].(string), 10, 64)
-				profileUrl := "https://github.com/" + login
-				link := "https://github.com/" + strings.ToLower(timeline[i]["repo"].(map[string]interface {})["name"].(string))
-				var title string
-				var text string
-				switch (timeline[i]["type"].(string)) {
-					case "CommitCommentEvent", "PullRequestReviewCommentEvent":
-						title = "commented"
-						text = timeline[i]["payload"].(map[string]interface {})["comment"].(map[string]interface {})["body"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["comment"].(map[string]interface {})["html_url"].(string)
-					case "CreateEvent":
-						ref_type := timeline[i]["payload"].(map[string]interface {})["ref_type"].(string)
-						ref := timeline[i]["repo"].(map[string]interface {})["name"].(string)
-						if ref_type != "repository" {
-							ref = timeline[i]["payload"].(map[string]interface {})["ref"].(string)
-						}
-						title = "created " + ref_type + " " + ref
-					case "DeleteEvent":
-						title = "deleted " + timeline[i]["payload"].(map[string]interface {})["ref_type"].(string)
-					case "DownloadEvent":
-						title = "uploaded " + timeline[i]["payload"].(map[string]interface {})["download"].(map[string]interface {})["name"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["download"].(map[string]interface {})["html_url"].(string)
-					case "FollowEvent":
-						title = "is now following " + timeline[i]["payload"].(map[string]interface {})["target"].(map[string]interface {})["login"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["target"].(map[string]interface {})["html_url"].(string)
-					case "ForkEvent":
-						title = "forked " + timeline[i]["repo"].(map[string]interface {})["name"].(string)
-					case "ForkApplyEvent":
-						title = "applied fork to " + timeline[i]["payload"].(map[string]interface {})["head"].(string)
-					case "GistEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + "d " + timeline[i]["payload"].(map[string]interface {})["gist"].(map[string]interface {})["description"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["gist"].(map[string]interface {})["html_url"].(string)
-					case "GollumEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["pages"].([]interface {})[0].(map[string]interface {})["action"].(string) + " page"
-						text = timeline[i]["payload"].(map[string]interface {})["pages"].([]interface {})[0].(map[string]interface {})["page_name"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["pages"].([]interface {})[0].(map[string]interface {})["html_url"].(string)
-					case "IssueCommentEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + " on issue #" +  timeline[i]["payload"].(map[string]interface {})["issue"].(map[string]interface {})["number"].(string)
-						text = timeline[i]["payload"].(map[string]interface {})["comment"].(map[string]interface {})["body"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["issue"].(map[string]interface {})["html_url"].(string)
-					case "IssuesEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + " issue #" +  timeline[i]["payload"].(map[string]interface {})["issue"].(map[string]interface {})["number"].(string)
-						text = timeline[i]["payload"].(map[string]interface {})["issue"].(map[string]interface {})["body"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["issue"].(map[string]interface {})["html_url"].(string)
-					case "MemberEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + " " +  timeline[i]["payload"].(map[string]interface {})["member"].(map[string]interface {})["login"].(string) + " to " + timeline[i]["repo"].(map[string]interface {})["name"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["member"].(map[string]interface {})["html_url"].(string)
-					case "PublicEvent":
-						title = "Open sourced " + timeline[i]["repo"].(map[string]interface {})["name"].(string) 
-					case "PullRequestEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + " pull request"
-						text = timeline[i]["payload"].(map[string]interface {})["pull_request"].(map[string]interface {})["title"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["pull_request"].(map[string]interface {})["html_url"].(string)
-					case "PushEvent":
-						title = "pushed to " + timeline[i]["repo"].(map[string]interface {})["name"].(string)
-						text = timeline[i]["payload"].(map[string]interface {})["commits"].([]interface{})[0].(map[string]interface{})["message"].(string)
-						if a.Repost {
-							tweets = append(tweets, map[string]string{"status": "I updated my app #" + strings.Replace(strings.Split(timeline[i]["repo"].(map[string]interface {})["name"].(string), "/")[1], "-", "", -1) + " on @github: " + text, "link": link})
-						}
-					case "TeamAddEvent":
-						title = "added " + timeline[i]["payload"].(map[string]interface {})["user"].(map[string]interface {})["login"].(string) + " to " + timeline[i]["payload"].(map[string]interface {})["team"].(map[string]interface {})["name"].(string)
-						link = timeline[i]["payload"].(map[string]interface {})["user"].(map[string]interface {})["html_url"].(string)
-					case "WatchEvent":
-						title = timeline[i]["payload"].(map[string]interface {})["action"].(string) + " watching " + timeline[i]["repo"].(map[string]interface {})["name"].(string)
-				}
-				if len(title) > 0 {
-					update := Status{Name: "github", OriginalId: id, Heading: title, Link: link, Content: text, Created: created_at, User: login, UserUrl: profileUrl}
-					Save(&update)
-				}
-			}
+		var body json.RawMessage
+		if err := decodeResponse(resp, &body); err != nil {
+			ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+			return
 		}
-		if a.Repost {
-			var twitter Account
-			GetByName(&twitter, "twitter")
-			twitter.PostTwitterUpdate(tweets)
+		updates, err := parseGithubEvents(body, login)
+		if err != nil {
+			ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+			return
 		}
+		replaceDeliveries(ctx, updates)
+		a.saveStatuses(ctx, updates, latest.Created)
     }
 }
 
+// Parse events, leaving out unsupported ones
+func parseGithubEvents(data []byte, login string) ([]parsedStatus, error) {
+	items, err := decodeItems(data)
+	if err != nil {
+		return nil, err
+	}
+	var updates []parsedStatus
+	for _, item := range items {
+		var event githubEvent
+		if err := json.Unmarshal(item, &event); err != nil {
+			skipMalformed("github", err)
+			continue
+		}
+		if update := event.status(login); len(update.Heading) > 0 {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+// Map event to Status and repost, with an empty heading for unsupported events
+func (event *githubEvent) status(login string) parsedStatus {
+	var tweet map[string]string
+	id, _ := strconv.ParseInt(string(event.Id), 10, 64)
+	profileUrl := "https://github.com/" + login
+	link := "https://github.com/" + strings.ToLower(event.Repo.Name)
+	payload := &event.Payload
+	var title string
+	var text string
+	switch (event.Type) {
+		case "CommitCommentEvent", "PullRequestReviewCommentEvent":
+			title = "commented"
+			text = payload.Comment.Body
+			link = payload.Comment.HtmlUrl
+		case "CreateEvent":
+			ref := event.Repo.Name
+			if payload.RefType != "repository" {
+				ref = string(payload.Ref)
+			}
+			title = "created " + payload.RefType + " " + ref
+		case "DeleteEvent":
+			title = "deleted " + payload.RefType
+		case "DownloadEvent":
+			title = "uploaded " + payload.Download.Name
+			link = payload.Download.HtmlUrl
+		case "FollowEvent":
+			title = "is now following " + payload.Target.Login
+			link = payload.Target.HtmlUrl
+		case "ForkEvent":
+			title = "forked " + event.Repo.Name
+		case "ForkApplyEvent":
+			title = "applied fork to " + string(payload.Head)
+		case "GistEvent":
+			title = payload.Action + "d " + payload.Gist.Description
+			link = payload.Gist.HtmlUrl
+		case "GollumEvent":
+			if len(payload.Pages) > 0 {
+				title = payload.Pages[0].Action + " page"
+				text = payload.Pages[0].PageName
+				link = payload.Pages[0].HtmlUrl
+			}
+		case "IssueCommentEvent":
+			title = payload.Action + " on issue #" + strconv.FormatInt(int64(payload.Issue.Number), 10)
+			text = payload.Comment.Body
+			link = payload.Issue.HtmlUrl
+		case "IssuesEvent":
+			title = payload.Action + " issue #" + strconv.FormatInt(int64(payload.Issue.Number), 10)
+			text = payload.Issue.Body
+			link = payload.Issue.HtmlUrl
+		case "MemberEvent":
+			title = payload.Action + " " + payload.Member.Login + " to " + event.Repo.Name
+			link = payload.Member.HtmlUrl
+		case "PublicEvent":
+			title = "Open sourced " + event.Repo.Name
+		case "PullRequestEvent":
+			title = payload.Action + " pull request"
+			text = payload.PullRequest.Title
+			link = payload.PullRequest.HtmlUrl
+		case "PushEvent":
+			title = "pushed to " + event.Repo.Name
+			if len(payload.Commits) > 0 {
+				text = payload.Commits[0].Message
+			}
+			repo := event.Repo.Name[strings.LastIndex(event.Repo.Name, "/") + 1:]
+			tweet = map[string]string{"status": "I updated my app #" + strings.Replace(repo, "-", "", -1) + " on @github: " + text, "link": link}
+		case "TeamAddEvent":
+			title = "added " + payload.User.Login + " to " + payload.Team.Name
+			link = payload.User.HtmlUrl
+		case "WatchEvent":
+			title = payload.Action + " watching " + event.Repo.Name
+	}
+	return parsedStatus{Status: Status{Name: "github", OriginalId: id, Guid: event.object(), Heading: title, Link: link, Content: text, Created: event.CreatedAt, User: login, UserUrl: profileUrl}, Repost: tweet}
+}
+
+// What the event is about, telling a polled event and the webhook delivery of it (which carries no event id) apart from others
+func (event *githubEvent) object() string {
+	payload := &event.Payload
+	object := string(payload.Head)
+	for _, url := range []string{payload.Comment.HtmlUrl, payload.PullRequest.HtmlUrl, payload.Issue.HtmlUrl, payload.Gist.HtmlUrl, payload.Download.HtmlUrl, payload.Target.HtmlUrl, payload.Member.HtmlUrl, payload.User.HtmlUrl} {
+		if url != "" {
+			object = url
+			break
+		}
+	}
+	if len(payload.Pages) > 0 {
+		object = payload.Pages[0].HtmlUrl + "@" + payload.Pages[0].Sha
+	}
+	return strings.Join([]string{event.Type, event.Repo.Name, payload.Action, payload.RefType, string(payload.Ref), object}, " ")
+}
 
 /*
  * LinkedIn Client
  */
  
+type linkedInProvider struct{}
+
+func (linkedInProvider) Name() string { return "linkedin" }
+func (linkedInProvider) Title() string { return "LinkedIn" }
+func (linkedInProvider) Version() int { return 2 }
+
+func (linkedInProvider) Defaults() Account {
+	return Account{RequestUrl: "r_basicprofile r_network", AuthUrl: "https://www.linkedin.com/uas/oauth2/authorization", AccessUrl: "https://www.linkedin.com/uas/oauth2/accessToken"}
+}
+
+func (linkedInProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetLinkedInUpdates(ctx)
+}
+
+type linkedInUpdates struct {
+	Total int `json:"_total"`
+	Values []json.RawMessage `json:"values"`
+}
+
+type linkedInUpdate struct {
+	UpdateContent struct {
+		Person struct {
+			CurrentShare struct {
+				Timestamp flexInt `json:"timestamp"`
+				Comment string `json:"comment"`
+				Content struct {
+					SubmittedUrl string `json:"submittedUrl"`
+				} `json:"content"`
+				Author struct {
+					FirstName string `json:"firstName"`
+					LastName string `json:"lastName"`
+				} `json:"author"`
+			} `json:"currentShare"`
+			SiteStandardProfileRequest struct {
+				Url string `json:"url"`
+			} `json:"siteStandardProfileRequest"`
+		} `json:"person"`
+	} `json:"updateContent"`
+}
 
 // Get Updates from LinkedIn
-func (a *Account) GetLinkedInUpdates(r *http.Request) {
+func (a *Account) GetLinkedInUpdates(ctx *Context) {
 	
 	// Initialize connection
-	var tweets []map[string]string
-	latest := Latest("linkedin")
+	latest := a.Latest(ctx)
 	url := "https://api.linkedin.com/v1/people/~/network/updates?format=json&scope=self&type=SHAR&oauth2_access_token=" + a.Token
 	if latest.OriginalId > 0 {
 		url = url + "&after=" + strconv.FormatInt(latest.OriginalId + 1, 10)
 	}
 	
 	// Fire request
-	resp, err := urlfetch.Client(c).Get(url)
+	resp, err := ctx.Client.Get(url)
 	if err != nil {
-		session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
 		return
 	}
 	defer resp.Body.Close()
-	var data map[string]interface{}
-	decodeResponse(resp, &data)
+	var body json.RawMessage
+	if err := decodeResponse(resp, &body); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
 	
 	// Parse and save timeline
-	if data["_total"] != nil && data["_total"].(float64) > 0 {
-		for i := 0; i < len(data["values"].([]interface{})); i++ {
-			content := data["values"].([]interface{})[i].(map[string]interface{})["updateContent"].(map[string]interface{})["person"].(map[string]interface{})
-			update := Status {
-				Name: "linkedin",
-				OriginalId: int64(content["currentShare"].(map[string]interface{})["timestamp"].(float64)),
-				Heading: "shared a link",
-				Created: time.Unix(int64(content["currentShare"].(map[string]interface{})["timestamp"].(float64)*0.001), 0),
-				User: content["currentShare"].(map[string]interface{})["author"].(map[string]interface{})["firstName"].(string) + " " + content["currentShare"].(map[string]interface{})["author"].(map[string]interface{})["lastName"].(string),
-				UserUrl: strings.Split(content["siteStandardProfileRequest"].(map[string]interface{})["url"].(string), "&")[0],
-			}
-			if content["currentShare"].(map[string]interface{})["comment"] != nil {
-				update.Heading = content["currentShare"].(map[string]interface{})["comment"].(string)
-			}
-			if content["currentShare"].(map[string]interface{})["content"] != nil {
-				update.Link = content["currentShare"].(map[string]interface{})["content"].(map[string]interface{})["submittedUrl"].(string)
-				update.Content = content["currentShare"].(map[string]interface{})["content"].(map[string]interface{})["submittedUrl"].(string)
-			}
-			if a.Repost {
-				status := update.Heading
-				if status == "shared a link" {
-					status = "I " + status
-				}
-				link := update.Link
-				if len(link) == 0 {
-					link = update.UserUrl
-				}
-				tweets = append(tweets, map[string]string{"status": status, "link": link})
-			}
-			Save(&update)
+	updates, err := parseLinkedInUpdates(body)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	a.saveStatuses(ctx, updates, time.Time{})
+}
+
+// Parse shares from network updates
+func parseLinkedInUpdates(data []byte) ([]parsedStatus, error) {
+	var list linkedInUpdates
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	var updates []parsedStatus
+	for _, item := range list.Values {
+		var value linkedInUpdate
+		if err := json.Unmarshal(item, &value); err != nil {
+			skipMalformed("linkedin", err)
+			continue
+		}
+		content := value.UpdateContent.Person
+		share := content.CurrentShare
+		if share.Timestamp == 0 {
+			skipMalformed("linkedin", errors.New("share without timestamp"))
+			continue
+		}
+		update := parsedStatus{Status: Status {
+			Name: "linkedin",
+			OriginalId: int64(share.Timestamp),
+			Heading: "shared a link",
+			Created: time.Unix(int64(share.Timestamp) / 1000, 0),
+			User: share.Author.FirstName + " " + share.Author.LastName,
+			UserUrl: strings.Split(content.SiteStandardProfileRequest.Url, "&")[0],
+		}}
+		if share.Comment != "" {
+			update.Heading = share.Comment
+		}
+		update.Link = share.Content.SubmittedUrl
+		update.Content = share.Content.SubmittedUrl
+		status := update.Heading
+		if status == "shared a link" {
+			status = "I " + status
 		}
-		if a.Repost {
-			var twitter Account
-			GetByName(&twitter, "twitter")
-			twitter.PostTwitterUpdate(tweets)
+		link := update.Link
+		if len(link) == 0 {
+			link = update.UserUrl
 		}
+		update.Repost = map[string]string{"status": status, "link": link}
+		updates = append(updates, update)
 	}
+	return updates, nil
 }
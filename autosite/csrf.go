@@ -0,0 +1,50 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+
+/*
+ * Anti-forgery tokens for all mutating requests
+ */
+
+// Session value holding the token
+const sessionCSRF = "csrf"
+
+// Returned for POST, PUT and DELETE requests without a valid token
+var ErrInvalidCSRFToken = errors.New("Invalid or missing anti-forgery token")
+
+// Return token of current session, creating (and saving) it if necessary
+func csrfToken(w http.ResponseWriter, ctx *Context) string {
+	if token, ok := ctx.Session.Values[sessionCSRF].(string); ok && token != "" {
+		return token
+	}
+	token := base64.RawURLEncoding.EncodeToString(randomKey(32))
+	ctx.Session.Values[sessionCSRF] = token
+	ctx.Session.Save(ctx.Request, w)
+	return token
+}
+
+// Check token sent as _csrf form field or X-CSRF-Token header (for AJAX calls)
+func verifyCSRFToken(ctx *Context) error {
+	expected, _ := ctx.Session.Values[sessionCSRF].(string)
+	sent := ctx.Request.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = ctx.Request.FormValue("_csrf")
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(sent)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
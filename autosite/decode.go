@@ -0,0 +1,121 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+
+/*
+ * Tolerant decoding of API responses (one malformed update must not spoil the others)
+ */
+
+// Update parsed from an API response, along with the post to repost it with (if any)
+type parsedStatus struct {
+	Status
+	Repost map[string]string
+}
+
+// String decoded from JSON strings and numbers alike
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		*s = flexString(str)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*s = flexString(n.String())
+	return nil
+}
+
+// Integer decoded from JSON numbers and numeric strings alike
+type flexInt int64
+
+func (i *flexInt) UnmarshalJSON(data []byte) error {
+	var s flexString
+	if err := s.UnmarshalJSON(data); err != nil || s == "" {
+		return err
+	}
+	// Exact for ids beyond 2^53, only non-integral numbers (e.g. "1.5e3") go through float
+	if n, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		*i = flexInt(n)
+		return nil
+	}
+	n, err := strconv.ParseFloat(string(s), 64)
+	if err != nil {
+		return err
+	}
+	*i = flexInt(n)
+	return nil
+}
+
+// Time decoded from RFC 3339 strings and unix timestamps alike
+type flexTime time.Time
+
+func (t *flexTime) UnmarshalJSON(data []byte) error {
+	var s flexString
+	if err := s.UnmarshalJSON(data); err != nil || s == "" {
+		return err
+	}
+	if n, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		*t = flexTime(time.Unix(n, 0).UTC())
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, string(s))
+	if err != nil {
+		return err
+	}
+	*t = flexTime(parsed)
+	return nil
+}
+
+// Split JSON array into its items, to be decoded one by one
+func decodeItems(data []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	if len(bytes.TrimSpace(data)) == 0 || bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return items, nil
+	}
+	err := json.Unmarshal(data, &items)
+	return items, err
+}
+
+// Log update that could not be decoded
+func skipMalformed(network string, err error) {
+	log.Printf("Skipping malformed %s update: %s", network, err.Error())
+}
+
+// Save parsed updates created after the given time, reposting them if the account is set up to
+func (a *Account) saveStatuses(ctx *Context, updates []parsedStatus, after time.Time) {
+	var posts []map[string]string
+	for _, update := range updates {
+		if !update.Created.After(after) {
+			continue
+		}
+		_, fresh, _ := a.saveStatus(ctx, &update.Status)
+		if fresh && update.Repost != nil && a.RepostTarget() != "" {
+			posts = append(posts, update.Repost)
+		}
+	}
+	repost(ctx, a.RepostTarget(), posts)
+}
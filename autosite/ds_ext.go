@@ -8,9 +8,10 @@
 package autosite
 
 import (
-	"appengine/datastore"
     "net/http"
+    "reflect"
     "regexp"
+    "strconv"
     "strings"
     "text/template"
     "time" 
@@ -26,52 +27,42 @@ type Model interface {
 }
 
 // Generic get by function
-func Get(m Model) string {
-	q := datastore.NewQuery(m.Type()).Limit(1)
-	for t := q.Run(c); ; {
-		key, err := t.Next(m)
-        if err != nil {
-			session.AddFlash("An error occured while loading: " + err.Error())
-			break
-        }
-        return key.Encode()
-	}
-	return ""
+func Get(ctx *Context, m Model) string {
+	return first(ctx, NewQuery(m.Type()).Limit(1), m)
 }
 
 // Generic get by function
-func GetByKey(m Model, key *datastore.Key) string {
-	if err := datastore.Get(c, key, m); err != nil {
-        session.AddFlash("An error occured while loading: " + err.Error())
+func GetByKey(ctx *Context, m Model, key string) string {
+	if err := ctx.Store.Get(key, m); err != nil {
+        ctx.Session.AddFlash("An error occured while loading: " + err.Error())
 		return ""
     }
-	return key.Encode()
+	return key
 }
 
 // Generic get by function
-func GetByName(m Model, name string) string {
-	q := datastore.NewQuery(m.Type()).Filter("Name =", name).Limit(1)
-	for t := q.Run(c); ; {
-		key, err := t.Next(m)
-        if err != nil {
-			session.AddFlash("An error occured while loading: " + err.Error())
-			break
-        }
-        return key.Encode()
-	}
-	return ""
+func GetByName(ctx *Context, m Model, name string) string {
+	return first(ctx, NewQuery(m.Type()).Filter("Name =", name).Limit(1), m)
 }
 
-// Convert string to datastore key
-func ToKey(k string) *datastore.Key {
-	key, _ := datastore.DecodeKey(k)
-	return key
+// Load first result of query into m
+func first(ctx *Context, q *Query, m Model) string {
+	results := reflect.New(reflect.SliceOf(reflect.TypeOf(m).Elem()))
+	keys, err := ctx.Store.GetAll(q, results.Interface())
+	if err == nil && len(keys) == 0 {
+		err = ErrNoSuchEntity
+	}
+	if err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+		return ""
+	}
+	reflect.ValueOf(m).Elem().Set(results.Elem().Index(0))
+	return keys[0]
 }
 
 // Generic count function
-func Count(kind string) (int, error) {
-	q := datastore.NewQuery(kind)
-	return q.Count(c)
+func Count(ctx *Context, kind string) (int, error) {
+	return ctx.Store.Count(NewQuery(kind))
 }
 
 // Initialize model from form
@@ -81,31 +72,38 @@ func Build(m Model, r *http.Request) {
 }
 
 // Save new model (random key)
-func Save(m Model) string {
-	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, m.Type(), nil), m)
+func Save(ctx *Context, m Model) string {
+	key, err := ctx.Store.Put(m.Type(), "", m)
 	if err != nil {
-		session.AddFlash("An error occured while saving: " + err.Error())
+		ctx.Session.AddFlash("An error occured while saving: " + err.Error())
 		return ""
     }
-    session.AddFlash(m.Type() + " has been saved successfully")
-	return key.Encode()
+    ctx.Session.AddFlash(m.Type() + " has been saved successfully")
+	return key
 }
 
 // Save new model (pre-defined key)
-func Update(m Model, k string) string {
-	key, err := datastore.Put(c, ToKey(k), m)
+func Update(ctx *Context, m Model, k string) string {
+	key, _ := updateModel(ctx, m, k)
+	return key
+}
+
+// Helper: Update, also reporting whether saving succeeded (the key is kept either way, for the form)
+func updateModel(ctx *Context, m Model, k string) (string, bool) {
+	key, err := ctx.Store.Put(m.Type(), k, m)
 	if err != nil {
-		session.AddFlash("An error occured while saving: " + err.Error())
+		ctx.Session.AddFlash("An error occured while saving: " + err.Error())
+		return k, false
     }
-    session.AddFlash(m.Type() + " has been saved successfully")
-	return key.Encode()
+    ctx.Session.AddFlash(m.Type() + " has been saved successfully")
+	return key, true
 }
 
 // Generic delete function
-func Delete(k string) {
-	err := datastore.Delete(c, ToKey(k))
+func Delete(ctx *Context, k string) {
+	err := ctx.Store.Delete(k)
 	if err != nil {
-		session.AddFlash("An error occured while deleting: " + err.Error())
+		ctx.Session.AddFlash("An error occured while deleting: " + err.Error())
     }
 }
 
@@ -119,7 +117,7 @@ type Site struct {
 	HomepageTitle	string
 	Footer	string
 	TrackerCode	[]byte
-	TemplateKey	*datastore.Key
+	TemplateKey	string
 }
 
 // Return own type as String
@@ -133,28 +131,24 @@ func (s *Site) TrackerCodeString() string {
 }
 
 // Return own type as String
-func (s *Site) Style() string {
+func (s *Site) Style(ctx *Context) string {
 	var css Page
-	GetByKey(&css, s.TemplateKey)
+	GetByKey(ctx, &css, s.TemplateKey)
 	return css.Name
 }
 
 // Return all templates as map
-func (s *Site) Templates() []map[string]string {
+func (s *Site) Templates(ctx *Context) []map[string]string {
 	var templates []map[string]string
-	q := datastore.NewQuery("Page").Order("Name")
-	for t := q.Run(c); ; {
-		var template Page
-		key, err := t.Next(&template)
-		if err == datastore.Done {
-			break
-        }
+	var pages []Page
+	keys, _ := ctx.Store.GetAll(NewQuery("Page").Order("Name"), &pages)
+	for i, template := range pages {
 		if template.IsTemplate() {
 			var selected string
-			if s.TemplateKey != nil && key.Encode() == s.TemplateKey.Encode() {
+			if keys[i] == s.TemplateKey {
 				selected = "selected"
 			}
-			templates = append(templates, map[string]string{"Key": key.Encode(), "Name": template.Name, "Selected": selected})
+			templates = append(templates, map[string]string{"Key": keys[i], "Name": template.Name, "Selected": selected})
 		}
 	}
 	return templates
@@ -171,6 +165,10 @@ type Page struct {
 	Body	[]byte
 	Name	string
 	Published	bool
+	Format	string
+	Source	[]byte
+	PublishAt	time.Time
+	UnpublishAt	time.Time
 }
 
 // Return own name
@@ -183,6 +181,33 @@ func (p *Page) BodyString() string {
 	return string(p.Body)
 }
 
+// Return body as written by the author (markdown source for markdown pages)
+func (p *Page) SourceString() string {
+	if p.IsMarkdown() {
+		return string(p.Source)
+	}
+	return string(p.Body)
+}
+
+// Check whether page is written in markdown (pages without format are HTML)
+func (p *Page) IsMarkdown() bool {
+	return p.Format == "markdown"
+}
+
+// Set body from the author's input, rendering markdown to sanitized HTML
+func (p *Page) SetBody(input string) error {
+	if p.IsTemplate() {
+		p.Body, p.Source = []byte(input), nil
+		return nil
+	}
+	body, source, err := formatBody(p.Format, input)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Source = body, source
+	return nil
+}
+
 // Check whether page is a (CSS-)template
 func (p *Page) IsTemplate() bool {
 	cssmatch, _ := regexp.Compile("\\.css$")
@@ -193,14 +218,13 @@ func (p *Page) IsTemplate() bool {
 }
 
 // Sort pages
-func SortPages(slugs []string) {
+func SortPages(ctx *Context, slugs []string) {
 	pages := make([]Page, 0)
-	q := datastore.NewQuery("Page")
-	keys, _ := q.GetAll(c, &pages)
+	keys, _ := ctx.Store.GetAll(NewQuery("Page"), &pages)
 	for i := 0; i < len(keys); i++ {
 		pages[i].Position = LookFor(slugs, pages[i].Name) + 1
+		ctx.Store.Put("Page", keys[i], &pages[i])
 	}
-	datastore.PutMulti(c, keys, pages)
 }
 
 
@@ -211,21 +235,39 @@ func SortPages(slugs []string) {
 type Account struct {
 	Name string
 	ConsumerKey string
-	ConsumerSecret string
-	Token string
-	Secret string
+	ConsumerSecret string `autosite:"secret"`
+	Token string `autosite:"secret"`
+	Secret string `autosite:"secret"`
 	RequestUrl string
 	AuthUrl string
 	AccessUrl string
 	Repost bool
 	Expires time.Time
+	RefreshToken string `autosite:"secret"`
+	PKCE bool
+	BaseUrl string
+	RepostTo string
+	WebhookSecret string `autosite:"secret"`
+	Retention string
+	RetentionLimit int
+	KeepArchive bool
+	LatestId int64
+	LatestGuid string
+	LatestCreated time.Time
+	LatestUser string
+	Sealed bool `autosite:"sealed" schema:"-"`
+	newest Status
 }
 
 func (a *Account) Type() string {
 	return "Account"
 }
 
+// OAuth version, as given by the provider (or guessed from the request URL for unregistered ones)
 func (a *Account) Version() int {
+	if p := a.Provider(); p != nil {
+		return p.Version()
+	}
 	reqmatch, _ := regexp.Compile("^http")
 	if reqmatch.FindString(a.RequestUrl) == "" {
 		return 2
@@ -233,60 +275,142 @@ func (a *Account) Version() int {
 	return 1
 }
 
-func (a *Account) Verified() bool {
-	return len(a.Token) > 0 && (a.Expires.IsZero() || time.Now().Before(a.Expires))
+// Registered provider for this account, or nil
+func (a *Account) Provider() Provider {
+	return AccountProvider(a.Name)
+}
+
+// Fill in the provider's default URLs where none are set
+func (a *Account) SetDefaults() {
+	if p := a.Provider(); p != nil {
+		d := p.Defaults()
+		if a.RequestUrl == "" {
+			a.RequestUrl = d.RequestUrl
+		}
+		if a.AuthUrl == "" {
+			a.AuthUrl = d.AuthUrl
+		}
+		if a.AccessUrl == "" {
+			a.AccessUrl = d.AccessUrl
+		}
+		if a.BaseUrl == "" {
+			a.BaseUrl = d.BaseUrl
+		}
+	}
+	if a.Retention == "" {
+		a.Retention, a.RetentionLimit = a.RetentionPolicy()
+	}
 }
 
-func (a *Account) Twitter() bool {
-	return a.Name == "twitter"
+// Name of the account to post updates to, if any (accounts from before RepostTo post to Twitter)
+func (a *Account) RepostTarget() string {
+	if a.RepostTo == "" && a.Repost {
+		return "twitter"
+	}
+	return a.RepostTo
 }
 
-func (a *Account) XING() bool {
-	return a.Name == "xing"
+// Check whether provider accepts webhooks
+func (a *Account) Webhook() bool {
+	_, ok := a.Provider().(WebhookProvider)
+	return ok
 }
 
-func (a *Account) LinkedIn() bool {
-	return a.Name == "linkedin"
+// Check whether provider can be set up more than once
+func (a *Account) MultiAccount() bool {
+	m, ok := a.Provider().(MultiAccountProvider)
+	return ok && m.MultiAccount()
 }
 
-func (a *Account) GitHub() bool {
-	return a.Name == "github"
+// Description of the access token field, or empty if the provider does not use one
+func (a *Account) TokenHint() string {
+	if p, ok := a.Provider().(TokenProvider); ok {
+		return p.TokenHint()
+	}
+	return ""
 }
 
-func Refresh(w http.ResponseWriter, r *http.Request) {
-	if extendMethod(r) == "GET" {
-		var account Account
-		q := datastore.NewQuery("Account")
-		for t := q.Run(c); ; {
-			_, err := t.Next(&account)
-			if err == datastore.Done {
-				break
+// Description of the base URL field, or empty if the provider does not use one
+func (a *Account) BaseUrlHint() string {
+	if p, ok := a.Provider().(BaseUrlProvider); ok {
+		return p.BaseUrlHint()
+	}
+	return ""
+}
+
+func (a *Account) Verified() bool {
+	if a.Version() == 0 {
+		return len(a.BaseUrl) > 0 && (a.TokenHint() == "" || len(a.Token) > 0)
+	}
+	return len(a.Token) > 0 && (!a.Expired() || len(a.RefreshToken) > 0)
+}
+
+// Check whether access token has expired (or is about to)
+func (a *Account) Expired() bool {
+	return !a.Expires.IsZero() && time.Now().Add(time.Minute).After(a.Expires)
+}
+
+func Refresh(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method == "GET" {
+		var accounts []Account
+		accountKeys, _ := ctx.Store.GetAll(NewQuery("Account"), &accounts)
+		for i, account := range accounts {
+			renewed := true
+			if account.Verified() && account.Version() == 2 && account.Expired() {
+				if err := account.renewOAuth2Token(ctx); err != nil {
+					ctx.Session.AddFlash("Error renewing " + account.Name + " authorization: " + err.Error())
+					renewed = false
+				} else if _, err := ctx.Store.Put("Account", accountKeys[i], &account); err != nil {
+					ctx.Session.AddFlash("Error saving renewed " + account.Name + " authorization: " + err.Error())
+				}
 			}
-			if account.Verified() {
-				if account.Version() == 2 {
-					account.prepareOAuth2Connection(r)
+			if account.Verified() && renewed {
+				if p := account.Provider(); p != nil {
+					p.FetchUpdates(ctx, &account)
 				}
-				switch account.Name {
-					case "github":
-						account.GetGithubUpdates(r)
-					case "linkedin":
-						account.GetLinkedInUpdates(r)
-					case "twitter":
-						account.GetTwitterUpdates(r)
-					case "xing":
-						account.GetXingUpdates(r)
+				if account.advanceLatest() {
+					if _, err := ctx.Store.Put("Account", accountKeys[i], &account); err != nil {
+						ctx.Session.AddFlash("Error saving " + account.Name + " updates: " + err.Error())
+					}
 				}
 			}
 		}
-		q = datastore.NewQuery("Status").Order("-Created").Offset(100).KeysOnly()
-		keys, err := q.GetAll(c, nil)
-		if err == nil && len(keys) > 0 {
-			datastore.DeleteMulti(c, keys)
-		}
+		// Whether or not fetching worked
+		expireTimeline(ctx, accounts)
 	}
 	pageTemplate, _ := template.ParseFiles("templates/manage/refresh.txt")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-    pageTemplate.Execute(w, map[string]interface{}{"notice": session.Flashes()})
+    pageTemplate.Execute(w, map[string]interface{}{"notice": ctx.Session.Flashes()})
+}
+
+
+/*
+ * User struct for admin area logins
+ */
+
+type User struct {
+	Name string
+	PasswordHash []byte
+	Created time.Time
+}
+
+func (u *User) Type() string {
+	return "User"
+}
+
+
+/*
+ * SessionKey struct for generated session cookie keys
+ */
+
+type SessionKey struct {
+	HashKey []byte
+	EncryptionKey []byte
+	Created time.Time
+}
+
+func (k *SessionKey) Type() string {
+	return "SessionKey"
 }
 
 
@@ -297,6 +421,7 @@ func Refresh(w http.ResponseWriter, r *http.Request) {
 type Status struct {
 	Name string
 	OriginalId int64
+	Guid string
 	Heading string
 	Content string
 	Link string
@@ -309,23 +434,66 @@ func (s *Status) Type() string {
 	return "Status"
 }
 
+// Key name unique per network and original id (empty if the network provided no id)
+func (s *Status) KeyName() string {
+	if s.OriginalId == 0 {
+		return ""
+	}
+	return s.Name + "-" + strconv.FormatInt(s.OriginalId, 10)
+}
+
+// Save update under its key name, so fetching it again replaces instead of duplicating it. Reports whether it is new.
+func (s *Status) Upsert(ctx *Context) (string, bool) {
+	if s.KeyName() == "" {
+		return Save(ctx, s), true
+	}
+	key := ctx.Store.NamedKey(s.Type(), s.KeyName())
+	var stored Status
+	var archived Archive
+	// Updates that expired into the archive were seen before, too
+	fresh := ctx.Store.Get(key, &stored) != nil && ctx.Store.Get(ctx.Store.NamedKey(archived.Type(), s.KeyName()), &archived) != nil
+	if _, err := ctx.Store.Put(s.Type(), key, s); err != nil {
+		ctx.Session.AddFlash("An error occured while saving: " + err.Error())
+		return "", false
+	}
+	ctx.Session.AddFlash(s.Type() + " has been saved successfully")
+	return key, fresh
+}
+
 func (s *Status) NameTitle() string {
+	if s.Name == postNetwork {
+		return "Blog"
+	}
+	if p := AccountProvider(s.Name); p != nil {
+		return p.Title()
+	}
 	return strings.Title(s.Name)
 }
 
-func Latest(name string) Status {
+// Link to the network the update came from
+func (s *Status) NameUrl() string {
+	if s.Name == postNetwork {
+		return "/blog"
+	}
+	if p, ok := AccountProvider(s.Name).(HomepageProvider); ok {
+		return p.Homepage(s)
+	}
+	return "http://" + s.Name + ".com"
+}
+
+func Latest(ctx *Context, name string) Status {
 	updates := make([]Status, 0)
-	q := datastore.NewQuery("Status").Filter("Name =", name).Order("-Created").Limit(1)
-	q.GetAll(c, &updates)
+	q := NewQuery("Status").Filter("Name =", name).Order("-Created").Limit(1)
+	ctx.Store.GetAll(q, &updates)
 	if len(updates) > 0 {
 		return updates[0]
 	}
 	return Status{}
 }
 
-func Timeline(page int) []*Status {
-	q := datastore.NewQuery("Status").Order("-Created").Limit(9).Offset((page-1) * 9)
+func Timeline(ctx *Context, page int) []*Status {
+	q := NewQuery("Status").Order("-Created").Limit(9).Offset((page-1) * 9)
 	var timeline []*Status
-	q.GetAll(c, &timeline)
+	ctx.Store.GetAll(q, &timeline)
 	return timeline
 }
@@ -0,0 +1,305 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+
+/*
+ * RSS 2.0 / Atom Client
+ */
+
+type feedProvider struct{}
+
+func (feedProvider) Name() string { return "feed" }
+func (feedProvider) Title() string { return "Feed" }
+func (feedProvider) Version() int { return 0 }
+
+func (feedProvider) Defaults() Account {
+	return Account{}
+}
+
+func (feedProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetFeedUpdates(ctx)
+}
+
+// Link to the feed's website instead of the network's
+func (feedProvider) Homepage(s *Status) string {
+	return s.UserUrl
+}
+
+// Any number of feeds, as accounts "feed", "feed-<name>" etc.
+func (feedProvider) MultiAccount() bool {
+	return true
+}
+
+func (feedProvider) BaseUrlHint() string {
+	return "The URL of an RSS 2.0 or Atom feed (e.g. of your blog)"
+}
+
+// Entry of either feed format
+type feedEntry struct {
+	Guid string
+	Title string
+	Link string
+	Content string
+	Created time.Time
+}
+
+// Feed with its entries, newest first as published
+type feed struct {
+	Title string
+	Link string
+	Entries []feedEntry
+}
+
+// RSS 2.0 document
+type rssDocument struct {
+	Channel struct {
+		Title string `xml:"title"`
+		// Also matches <atom:link rel="self" href="..."/>, which has no text
+		Links []string `xml:"link"`
+		Items []struct {
+			Guid string `xml:"guid"`
+			Title string `xml:"title"`
+			Link string `xml:"link"`
+			Description string `xml:"description"`
+			PubDate string `xml:"pubDate"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// Atom document
+type atomDocument struct {
+	Title string `xml:"title"`
+	Links []atomLink `xml:"link"`
+	Entries []struct {
+		Id string `xml:"id"`
+		Title string `xml:"title"`
+		Links []atomLink `xml:"link"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+		Published string `xml:"published"`
+		Updated string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// Date formats found in the wild
+var feedTimeFormats = []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", time.RFC822Z, time.RFC822, time.RFC3339, "2006-01-02T15:04:05"}
+
+// Get updates from the configured feed, stopping at the last seen entry
+func (a *Account) GetFeedUpdates(ctx *Context) {
+	var tweets []map[string]string
+	resp, err := ctx.Client.Get(a.BaseUrl)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("Get %s returned status %d", a.BaseUrl, resp.StatusCode)
+	}
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	f, err := parseFeed(data)
+	if err != nil {
+		ctx.Session.AddFlash("Error parsing " + a.Name + " updates: " + err.Error())
+		return
+	}
+	now := time.Now()
+	for i := range f.Entries {
+		if f.Entries[i].Created.IsZero() {
+			// Keep undated entries in feed order, a second apart
+			f.Entries[i].Created = a.firstSeen(ctx, f.Entries[i].Guid, now.Add(-time.Duration(i) * time.Second))
+		}
+	}
+	latest := a.Latest(ctx)
+	for _, entry := range newFeedEntries(f.Entries, latest) {
+		update := Status {
+			Name: a.Name,
+			OriginalId: feedId(entry.Guid),
+			Guid: entry.Guid,
+			Heading: entry.Title,
+			Content: entry.Content,
+			Link: entry.Link,
+			Created: entry.Created,
+			User: f.Title,
+			UserUrl: f.Link,
+		}
+		if _, fresh, _ := a.saveStatus(ctx, &update); fresh && a.RepostTarget() != "" {
+			tweets = append(tweets, map[string]string{"status": entry.Title, "link": entry.Link})
+		}
+	}
+	repost(ctx, a.RepostTarget(), tweets)
+}
+
+// Time an undated entry was saved at when fetched before (still on the timeline or archived), else now
+func (a *Account) firstSeen(ctx *Context, guid string, now time.Time) time.Time {
+	seen := Status{Name: a.Name, OriginalId: feedId(guid)}
+	var stored Status
+	if ctx.Store.Get(ctx.Store.NamedKey(stored.Type(), seen.KeyName()), &stored) == nil {
+		return stored.Created
+	}
+	var archived Archive
+	if ctx.Store.Get(ctx.Store.NamedKey(archived.Type(), seen.KeyName()), &archived) == nil {
+		return archived.Created
+	}
+	return now
+}
+
+// Entries published since the latest saved one, oldest first
+func newFeedEntries(entries []feedEntry, latest Status) []feedEntry {
+	var fresh []feedEntry
+	for _, entry := range entries {
+		if latest.Guid != "" && entry.Guid == latest.Guid {
+			// Feeds list newest first, so everything after the last seen entry is known
+			break
+		}
+		if latest.Guid == "" || entry.Created.After(latest.Created) {
+			fresh = append(fresh, entry)
+		}
+	}
+	for i, j := 0, len(fresh) - 1; i < j; i, j = i + 1, j - 1 {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	}
+	return fresh
+}
+
+// Parse RSS 2.0 or Atom document
+func parseFeed(data []byte) (*feed, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	f := &feed{}
+	switch root.XMLName.Local {
+		case "rss":
+			var doc rssDocument
+			if err := xml.Unmarshal(data, &doc); err != nil {
+				return nil, err
+			}
+			f.Title, f.Link = strings.TrimSpace(doc.Channel.Title), rssLink(doc.Channel.Links)
+			for _, item := range doc.Channel.Items {
+				entry := feedEntry{Guid: strings.TrimSpace(item.Guid), Title: strings.TrimSpace(item.Title), Link: strings.TrimSpace(item.Link), Content: plainText(item.Description, 300), Created: parseFeedTime(item.PubDate)}
+				if entry.identify(item.PubDate) {
+					f.Entries = append(f.Entries, entry)
+				}
+			}
+		case "feed":
+			var doc atomDocument
+			if err := xml.Unmarshal(data, &doc); err != nil {
+				return nil, err
+			}
+			f.Title, f.Link = strings.TrimSpace(doc.Title), atomHref(doc.Links)
+			for _, item := range doc.Entries {
+				content := item.Summary
+				if content == "" {
+					content = item.Content
+				}
+				published := item.Published
+				if published == "" {
+					published = item.Updated
+				}
+				entry := feedEntry{Guid: strings.TrimSpace(item.Id), Title: strings.TrimSpace(item.Title), Link: atomHref(item.Links), Content: plainText(content, 300), Created: parseFeedTime(published)}
+				if entry.identify(published) {
+					f.Entries = append(f.Entries, entry)
+				}
+			}
+		default:
+			return nil, errors.New("Not an RSS or Atom feed")
+	}
+	return f, nil
+}
+
+// Fall back to link, then title and date as guid, reporting false (and logging) if the entry has none of them
+func (entry *feedEntry) identify(date string) bool {
+	if entry.Guid == "" {
+		entry.Guid = entry.Link
+	}
+	if entry.Guid == "" {
+		entry.Guid = strings.TrimSpace(entry.Title + " " + strings.TrimSpace(date))
+	}
+	if entry.Guid == "" {
+		skipMalformed("feed", errors.New("entry without guid, link, title or date"))
+		return false
+	}
+	return true
+}
+
+// First non-empty <link> text of an RSS channel
+func rssLink(links []string) string {
+	for _, link := range links {
+		if link = strings.TrimSpace(link); link != "" {
+			return link
+		}
+	}
+	return ""
+}
+
+// Pick alternate (or first) link
+func atomHref(links []atomLink) string {
+	for _, link := range links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			return strings.TrimSpace(link.Href)
+		}
+	}
+	if len(links) > 0 {
+		return strings.TrimSpace(links[0].Href)
+	}
+	return ""
+}
+
+// Parse entry date, zero if missing or in none of the formats
+func parseFeedTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, format := range feedTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+var tagMatcher = regexp.MustCompile("<[^>]*>")
+
+// Strip markup and shorten to max characters
+func plainText(markup string, max int) string {
+	text := strings.Join(strings.Fields(html.UnescapeString(tagMatcher.ReplaceAllString(markup, " "))), " ")
+	if runes := []rune(text); len(runes) > max {
+		text = string(runes[:max - 3]) + "..."
+	}
+	return text
+}
+
+// Numeric id derived from the entry's GUID
+func feedId(guid string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(guid))
+	return int64(h.Sum64() >> 1)
+}
@@ -0,0 +1,403 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Self-hosted forges (shared mapping of push, merge request, issue and tag events)
+ */
+
+// Forge activity, normalized across GitLab and Gitea
+type forgeEvent struct {
+	Id int64
+	Created time.Time
+	// push, tag, branch, repository, merge_request, issue or comment
+	Kind string
+	// opened, closed, merged, reopened, created, deleted, ...
+	Action string
+	Repo string
+	RepoUrl string
+	Ref string
+	Number int64
+	Title string
+	Text string
+	Link string
+}
+
+// Map event to Status heading, content and link as for GitHub, with an empty heading for unsupported events
+func (e *forgeEvent) heading(requestNoun string) (string, string, string) {
+	link := e.Link
+	if link == "" {
+		link = e.RepoUrl
+	}
+	switch e.Kind {
+		case "push":
+			return "pushed to " + e.Repo, e.Text, link
+		case "tag", "branch":
+			if e.Action == "deleted" {
+				return "deleted " + e.Kind, "", link
+			}
+			return "created " + e.Kind + " " + e.Ref, "", link
+		case "repository":
+			return "created repository " + e.Repo, "", link
+		case "merge_request":
+			return e.Action + " " + requestNoun, e.Title, link
+		case "issue":
+			return e.Action + " issue #" + strconv.FormatInt(e.Number, 10), e.Title, link
+		case "comment":
+			return "commented", e.Text, link
+	}
+	return "", "", ""
+}
+
+// Save events newer than the latest saved update, collecting pushes for reposting
+func (a *Account) saveForgeEvents(ctx *Context, events []forgeEvent, requestNoun string, user string, userUrl string) {
+	var tweets []map[string]string
+	latest := a.Latest(ctx)
+	title := a.Name
+	if p := a.Provider(); p != nil {
+		title = p.Title()
+	}
+	for _, e := range events {
+		if !e.Created.After(latest.Created) {
+			continue
+		}
+		heading, text, link := e.heading(requestNoun)
+		if heading == "" {
+			continue
+		}
+		update := Status{Name: a.Name, OriginalId: e.Id, Heading: heading, Link: link, Content: text, Created: e.Created, User: user, UserUrl: userUrl}
+		if _, fresh, _ := a.saveStatus(ctx, &update); fresh && e.Kind == "push" && a.RepostTarget() != "" {
+			parts := strings.Split(e.Repo, "/")
+			tweets = append(tweets, map[string]string{"status": "I updated my app #" + strings.Replace(parts[len(parts) - 1], "-", "", -1) + " on " + title + ": " + text, "link": link})
+		}
+	}
+	repost(ctx, a.RepostTarget(), tweets)
+}
+
+// Issue GET request with the given auth header against the forge's API, decoding the response JSON to data
+func (a *Account) forgeGet(ctx *Context, path string, params url.Values, header string, value string, data interface{}) error {
+	urlStr := strings.TrimRight(a.BaseUrl, "/") + path
+	if len(params) > 0 {
+		urlStr += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, value)
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp, data)
+}
+
+// Issue GET request like forgeGet, returning the listed items undecoded (to be decoded one by one)
+func (a *Account) forgeList(ctx *Context, path string, params url.Values, header string, value string) ([]json.RawMessage, error) {
+	var body json.RawMessage
+	if err := a.forgeGet(ctx, path, params, header, value, &body); err != nil {
+		return nil, err
+	}
+	return decodeItems(body)
+}
+
+// Scheme and host of a profile URL, linking to the instance the update came from
+func forgeHomepage(s *Status) string {
+	u, err := url.Parse(s.UserUrl)
+	if err != nil || u.Host == "" {
+		return "http://" + s.Name + ".com"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// First line of a commit message
+func firstLine(message string) string {
+	return strings.TrimSpace(strings.SplitN(message, "\n", 2)[0])
+}
+
+
+/*
+ * GitLab Client
+ */
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) Name() string { return "gitlab" }
+func (gitlabProvider) Title() string { return "GitLab" }
+func (gitlabProvider) Version() int { return 0 }
+
+func (gitlabProvider) Defaults() Account {
+	return Account{BaseUrl: "https://gitlab.com"}
+}
+
+func (gitlabProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetGitlabUpdates(ctx)
+}
+
+func (gitlabProvider) Homepage(s *Status) string {
+	return forgeHomepage(s)
+}
+
+func (gitlabProvider) BaseUrlHint() string {
+	return "The URL of your GitLab instance (e.g. https://gitlab.com)"
+}
+
+func (gitlabProvider) TokenHint() string {
+	return "A personal access token with the read_api scope"
+}
+
+type gitlabUser struct {
+	Id int64 `json:"id"`
+	Username string `json:"username"`
+	Name string `json:"name"`
+	WebUrl string `json:"web_url"`
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebUrl string `json:"web_url"`
+}
+
+type gitlabEvent struct {
+	Id int64 `json:"id"`
+	ProjectId int64 `json:"project_id"`
+	ActionName string `json:"action_name"`
+	TargetType string `json:"target_type"`
+	TargetIid int64 `json:"target_iid"`
+	TargetTitle string `json:"target_title"`
+	CreatedAt time.Time `json:"created_at"`
+	Note *struct {
+		Body string `json:"body"`
+		NoteableType string `json:"noteable_type"`
+		NoteableIid int64 `json:"noteable_iid"`
+	} `json:"note"`
+	PushData *struct {
+		Action string `json:"action"`
+		RefType string `json:"ref_type"`
+		Ref string `json:"ref"`
+		CommitTitle string `json:"commit_title"`
+	} `json:"push_data"`
+}
+
+// Get updates from GitLab
+func (a *Account) GetGitlabUpdates(ctx *Context) {
+	var user gitlabUser
+	if err := a.forgeGet(ctx, "/api/v4/user", nil, "PRIVATE-TOKEN", a.Token, &user); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " user info: " + err.Error())
+		return
+	}
+	params := url.Values{"per_page": {"50"}}
+	if latest := a.Latest(ctx); latest.OriginalId > 0 {
+		// Only takes a date, newer events of that day are picked by time below
+		params.Set("after", latest.Created.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	timeline, err := a.forgeList(ctx, "/api/v4/users/" + strconv.FormatInt(user.Id, 10) + "/events", params, "PRIVATE-TOKEN", a.Token)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	projects := map[int64]gitlabProject{}
+	var events []forgeEvent
+	for _, item := range timeline {
+		var ge gitlabEvent
+		if err := json.Unmarshal(item, &ge); err != nil {
+			skipMalformed(a.Name, err)
+			continue
+		}
+		project, ok := projects[ge.ProjectId]
+		if !ok && ge.ProjectId > 0 {
+			if err := a.forgeGet(ctx, "/api/v4/projects/" + strconv.FormatInt(ge.ProjectId, 10), nil, "PRIVATE-TOKEN", a.Token, &project); err != nil {
+				ctx.Session.AddFlash("Error getting " + a.Name + " project info: " + err.Error())
+			}
+			projects[ge.ProjectId] = project
+		}
+		events = append(events, ge.forgeEvent(project))
+	}
+	a.saveForgeEvents(ctx, events, "merge request", user.Username, user.WebUrl)
+}
+
+// Normalize GitLab event
+func (ge *gitlabEvent) forgeEvent(project gitlabProject) forgeEvent {
+	e := forgeEvent{Id: ge.Id, Created: ge.CreatedAt, Action: ge.ActionName, Repo: project.PathWithNamespace, RepoUrl: project.WebUrl, Number: ge.TargetIid, Title: ge.TargetTitle}
+	switch {
+		case ge.PushData != nil:
+			e.Ref = ge.PushData.Ref
+			switch {
+				case ge.PushData.Action == "removed":
+					e.Kind, e.Action = ge.PushData.RefType, "deleted"
+				case ge.PushData.RefType == "tag":
+					e.Kind, e.Action = "tag", "created"
+				default:
+					e.Kind, e.Text = "push", ge.PushData.CommitTitle
+			}
+		case ge.TargetType == "MergeRequest":
+			e.Kind = "merge_request"
+			e.Link = project.WebUrl + "/-/merge_requests/" + strconv.FormatInt(ge.TargetIid, 10)
+		case ge.TargetType == "Issue":
+			e.Kind = "issue"
+			e.Link = project.WebUrl + "/-/issues/" + strconv.FormatInt(ge.TargetIid, 10)
+		case ge.Note != nil:
+			e.Kind, e.Text = "comment", ge.Note.Body
+			if ge.Note.NoteableType == "MergeRequest" {
+				e.Link = project.WebUrl + "/-/merge_requests/" + strconv.FormatInt(ge.Note.NoteableIid, 10)
+			} else if ge.Note.NoteableType == "Issue" {
+				e.Link = project.WebUrl + "/-/issues/" + strconv.FormatInt(ge.Note.NoteableIid, 10)
+			}
+		case ge.ActionName == "created" && ge.TargetType == "":
+			e.Kind = "repository"
+	}
+	return e
+}
+
+
+/*
+ * Gitea / Forgejo Client
+ */
+
+type giteaProvider struct{}
+
+func (giteaProvider) Name() string { return "gitea" }
+func (giteaProvider) Title() string { return "Gitea" }
+func (giteaProvider) Version() int { return 0 }
+
+func (giteaProvider) Defaults() Account {
+	return Account{}
+}
+
+func (giteaProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetGiteaUpdates(ctx)
+}
+
+func (giteaProvider) Homepage(s *Status) string {
+	return forgeHomepage(s)
+}
+
+func (giteaProvider) BaseUrlHint() string {
+	return "The URL of your Gitea or Forgejo instance (e.g. https://codeberg.org)"
+}
+
+func (giteaProvider) TokenHint() string {
+	return "An access token with read permission for user and repository"
+}
+
+type giteaUser struct {
+	Login string `json:"login"`
+	HtmlUrl string `json:"html_url"`
+}
+
+type giteaActivity struct {
+	Id int64 `json:"id"`
+	OpType string `json:"op_type"`
+	RefName string `json:"ref_name"`
+	Content string `json:"content"`
+	Created time.Time `json:"created"`
+	Repo *struct {
+		FullName string `json:"full_name"`
+		HtmlUrl string `json:"html_url"`
+	} `json:"repo"`
+}
+
+// Get updates from Gitea or Forgejo
+func (a *Account) GetGiteaUpdates(ctx *Context) {
+	var user giteaUser
+	if err := a.forgeGet(ctx, "/api/v1/user", nil, "Authorization", "token " + a.Token, &user); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " user info: " + err.Error())
+		return
+	}
+	if user.HtmlUrl == "" {
+		user.HtmlUrl = strings.TrimRight(a.BaseUrl, "/") + "/" + user.Login
+	}
+	params := url.Values{"only-performed-by": {"true"}, "limit": {"50"}}
+	timeline, err := a.forgeList(ctx, "/api/v1/users/" + url.PathEscape(user.Login) + "/activities/feeds", params, "Authorization", "token " + a.Token)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	var events []forgeEvent
+	for _, item := range timeline {
+		var ga giteaActivity
+		if err := json.Unmarshal(item, &ga); err != nil {
+			skipMalformed(a.Name, err)
+			continue
+		}
+		events = append(events, ga.forgeEvent())
+	}
+	a.saveForgeEvents(ctx, events, "pull request", user.Login, user.HtmlUrl)
+}
+
+// Normalize Gitea activity
+func (ga *giteaActivity) forgeEvent() forgeEvent {
+	e := forgeEvent{Id: ga.Id, Created: ga.Created, Ref: ga.RefName}
+	if ga.Repo != nil {
+		e.Repo, e.RepoUrl = ga.Repo.FullName, ga.Repo.HtmlUrl
+	}
+	e.Ref = strings.TrimPrefix(strings.TrimPrefix(e.Ref, "refs/heads/"), "refs/tags/")
+	// Issue and pull request activities hold "index|title" (or "index|comment")
+	index, text := ga.Content, ""
+	if parts := strings.SplitN(ga.Content, "|", 2); len(parts) == 2 {
+		index, text = parts[0], parts[1]
+	}
+	e.Number, _ = strconv.ParseInt(index, 10, 64)
+	switch ga.OpType {
+		case "commit_repo", "mirror_sync_push":
+			e.Kind = "push"
+			var push struct {
+				Commits []struct {
+					Message string
+				}
+			}
+			if json.Unmarshal([]byte(ga.Content), &push) == nil && len(push.Commits) > 0 {
+				e.Text = firstLine(push.Commits[0].Message)
+			}
+		case "push_tag", "mirror_sync_create":
+			e.Kind, e.Action = "tag", "created"
+		case "delete_tag", "mirror_sync_delete":
+			e.Kind, e.Action = "tag", "deleted"
+		case "delete_branch":
+			e.Kind, e.Action = "branch", "deleted"
+		case "create_repo":
+			e.Kind = "repository"
+		case "create_issue", "close_issue", "reopen_issue":
+			e.Kind, e.Action, e.Title = "issue", giteaAction(ga.OpType), text
+			e.Link = e.RepoUrl + "/issues/" + index
+		case "create_pull_request", "close_pull_request", "reopen_pull_request", "merge_pull_request", "auto_merge_pull_request":
+			e.Kind, e.Action, e.Title = "merge_request", giteaAction(ga.OpType), text
+			e.Link = e.RepoUrl + "/pulls/" + index
+		case "comment_issue":
+			e.Kind, e.Text = "comment", text
+			e.Link = e.RepoUrl + "/issues/" + index
+		case "comment_pull":
+			e.Kind, e.Text = "comment", text
+			e.Link = e.RepoUrl + "/pulls/" + index
+	}
+	return e
+}
+
+// Past tense action of an op type
+func giteaAction(opType string) string {
+	switch strings.SplitN(opType, "_", 2)[0] {
+		case "create":
+			return "opened"
+		case "close":
+			return "closed"
+		case "reopen":
+			return "reopened"
+	}
+	return "merged"
+}
@@ -0,0 +1,216 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Webhooks (pushed updates, verified with a per-account secret instead of a session)
+ */
+
+// Largest payload accepted
+const webhookMaxBody = 5 << 20
+
+// How far the time in a delivery may be from the time polling gives the same event
+const webhookSkew = 5 * time.Minute
+
+// Handler: Receive webhook for the provider in the URL (not wrapped in Handler, as there is no session or CSRF token)
+func WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := &Context{Store: sealedStore{Storage(r)}, Client: HTTPClient(r), Request: r, Vars: mux.Vars(r), Method: r.Method}
+	// Never saved, only collects messages for the log
+	ctx.Session = sessions.NewSession(sessionStore(ctx.Store), sessionName)
+	hook, ok := LookupProvider(ctx.Vars["provider"]).(WebhookProvider)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var account Account
+	if GetByName(ctx, &account, ctx.Vars["provider"]) == "" || account.WebhookSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, webhookMaxBody))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	// The account is not saved, so deliveries never move the mark polling continues from
+	status := hook.ServeWebhook(ctx, &account, body)
+	for _, flash := range ctx.Session.Flashes() {
+		log.Printf("Webhook %s: %v", account.Name, flash)
+	}
+	w.WriteHeader(status)
+}
+
+// Check "sha256=<hex>" HMAC signature of body
+func validSignature(secret string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte("sha256=" + hex.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
+
+
+/*
+ * GitHub webhooks
+ */
+
+func (githubProvider) ServeWebhook(ctx *Context, a *Account, body []byte) int {
+	return a.ServeGithubWebhook(ctx, body)
+}
+
+// Verify delivery and save it as Status, mapped like events from the events API
+func (a *Account) ServeGithubWebhook(ctx *Context, body []byte) int {
+	if !validSignature(a.WebhookSecret, body, ctx.Request.Header.Get("X-Hub-Signature-256")) {
+		return http.StatusForbidden
+	}
+	kind := ctx.Request.Header.Get("X-GitHub-Event")
+	if kind == "ping" {
+		return http.StatusOK
+	}
+	var delivery struct {
+		After string `json:"after"`
+		HeadCommit struct {
+			Timestamp flexTime `json:"timestamp"`
+		} `json:"head_commit"`
+		Repository struct {
+			FullName string `json:"full_name"`
+			PushedAt flexTime `json:"pushed_at"`
+		} `json:"repository"`
+		Comment struct {
+			CreatedAt flexTime `json:"created_at"`
+		} `json:"comment"`
+		Issue struct {
+			UpdatedAt flexTime `json:"updated_at"`
+		} `json:"issue"`
+		PullRequest struct {
+			UpdatedAt flexTime `json:"updated_at"`
+		} `json:"pull_request"`
+		Sender githubUser `json:"sender"`
+	}
+	event := githubEvent{Type: githubEventType(kind)}
+	if err := json.Unmarshal(body, &delivery); err != nil {
+		return http.StatusBadRequest
+	}
+	if err := json.Unmarshal(body, &event.Payload); err != nil {
+		log.Printf("Webhook %s: skipping malformed %s event: %s", a.Name, kind, err.Error())
+		return http.StatusAccepted
+	}
+	if delivery.Repository.FullName == "" || delivery.Sender.Login == "" {
+		return http.StatusAccepted
+	}
+	// Only the account owner's own events belong on the timeline (polling learns who that is)
+	if !strings.EqualFold(delivery.Sender.Login, a.LatestUser) {
+		log.Printf("Webhook %s: ignoring %s event by %s", a.Name, kind, delivery.Sender.Login)
+		return http.StatusAccepted
+	}
+	// Id and time come from the payload, as for the same event polled from the events API
+	event.Repo.Name = delivery.Repository.FullName
+	times := []flexTime{delivery.Comment.CreatedAt, delivery.PullRequest.UpdatedAt, delivery.Issue.UpdatedAt}
+	if event.Type == "PushEvent" {
+		// Repositories tell when they were last pushed to in every delivery, but only in push deliveries is that this event
+		event.Payload.Head = flexString(delivery.After)
+		times = []flexTime{delivery.Repository.PushedAt, delivery.HeadCommit.Timestamp}
+	}
+	for _, t := range times {
+		if !time.Time(t).IsZero() {
+			event.CreatedAt = time.Time(t).UTC()
+			break
+		}
+	}
+	if event.CreatedAt.IsZero() {
+		// Nothing to date the event by, so leave it to polling
+		return http.StatusAccepted
+	}
+	update := event.status(delivery.Sender.Login)
+	if len(update.Heading) == 0 {
+		return http.StatusAccepted
+	}
+	// Without an event id, keyed by what happened when (polling replaces it with the event id later)
+	update.OriginalId = deliveryId(&update.Status)
+	if keys, _ := sameEvent(ctx, &update.Status); len(keys) > 0 {
+		// Polled before
+		return http.StatusOK
+	}
+	// Saved regardless of the polling mark (redeliveries just replace it)
+	key, fresh := update.Upsert(ctx)
+	if key == "" {
+		return http.StatusInternalServerError
+	}
+	if fresh && update.Repost != nil {
+		repost(ctx, a.RepostTarget(), []map[string]string{update.Repost})
+	}
+	return http.StatusOK
+}
+
+// Helper: Id of webhook delivery of an update, as there is no event id
+func deliveryId(s *Status) int64 {
+	return feedId(s.Guid + " " + s.Created.UTC().Format(time.RFC3339))
+}
+
+// Helper: Other updates about the same thing at about the same time, i.e. the webhook delivery and the polled copy of one event
+func sameEvent(ctx *Context, s *Status) ([]string, []Status) {
+	if s.Guid == "" {
+		return nil, nil
+	}
+	var found []Status
+	keys, err := ctx.Store.GetAll(NewQuery("Status").Filter("Guid =", s.Guid), &found)
+	if err != nil {
+		return nil, nil
+	}
+	var sameKeys []string
+	var same []Status
+	for i, f := range found {
+		skew := f.Created.Sub(s.Created)
+		if f.Name == s.Name && f.OriginalId != s.OriginalId && skew <= webhookSkew && skew >= -webhookSkew {
+			sameKeys, same = append(sameKeys, keys[i]), append(same, f)
+		}
+	}
+	return sameKeys, same
+}
+
+// Helper: Delete webhook deliveries of polled events, which take their place without being reposted again
+func replaceDeliveries(ctx *Context, updates []parsedStatus) {
+	for i := range updates {
+		keys, same := sameEvent(ctx, &updates[i].Status)
+		for j := range same {
+			// Polled events stay, even if about the same thing (e.g. pushing the same commits twice)
+			if same[j].OriginalId == deliveryId(&same[j]) && ctx.Store.Delete(keys[j]) == nil {
+				updates[i].Repost = nil
+			}
+		}
+	}
+}
+
+// Events API type for webhook event name, e.g. "PullRequestEvent" for "pull_request"
+func githubEventType(kind string) string {
+	var name string
+	for _, part := range strings.Split(kind, "_") {
+		if len(part) > 0 {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return name + "Event"
+}
@@ -0,0 +1,98 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"bytes"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+
+/*
+ * Markdown pages (rendered to sanitized HTML when saved, so visitors get plain HTML)
+ */
+
+// CommonMark plus GitHub's tables, strikethrough and autolinks, with ids on headings for anchors
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	// Inline HTML is passed on to the sanitizer instead of dropped
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// Elements and attributes allowed in rendered pages
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^[\p{L}\p{M}\p{Nd}_-]+$`)).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[a-zA-Z0-9_+-]+$`)).OnElements("code")
+	return p
+}()
+
+// Return HTML body and markdown source (if any) for the author's input in given format
+func formatBody(format string, input string) ([]byte, []byte, error) {
+	if format != "markdown" {
+		return []byte(input), nil, nil
+	}
+	body, err := renderMarkdown([]byte(input))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, []byte(input), nil
+}
+
+// Render markdown source to sanitized HTML
+func renderMarkdown(source []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert(source, &buf, parser.WithContext(parser.NewContext(parser.WithIDs(headingIds{})))); err != nil {
+		return nil, err
+	}
+	return markdownPolicy.SanitizeBytes(buf.Bytes()), nil
+}
+
+// Heading ids made of the lowercased letters and digits of any script, joined by dashes (goldmark's own drop all but ASCII)
+type headingIds map[string]bool
+
+func (ids headingIds) Generate(value []byte, kind ast.NodeKind) []byte {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(string(value)) {
+		if unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r) || r == '_' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	id := b.String()
+	if id == "" {
+		id = "heading"
+	}
+	// Numbered when taken by an earlier heading
+	unique := id
+	for i := 1; ids[unique]; i++ {
+		unique = id + "-" + strconv.Itoa(i)
+	}
+	ids[unique] = true
+	return []byte(unique)
+}
+
+func (ids headingIds) Put(value []byte) {
+	ids[string(value)] = true
+}
@@ -0,0 +1,220 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Mastodon Client
+ */
+
+type mastodonProvider struct{}
+
+func (mastodonProvider) Name() string { return "mastodon" }
+func (mastodonProvider) Title() string { return "Mastodon" }
+func (mastodonProvider) Version() int { return 2 }
+
+func (mastodonProvider) Defaults() Account {
+	return Account{RequestUrl: "read write", BaseUrl: "https://mastodon.social"}
+}
+
+func (mastodonProvider) FetchUpdates(ctx *Context, a *Account) {
+	a.GetMastodonUpdates(ctx)
+}
+
+func (mastodonProvider) PostUpdates(ctx *Context, a *Account, posts []map[string]string) {
+	a.PostMastodonUpdate(ctx, posts)
+}
+
+func (mastodonProvider) Homepage(s *Status) string {
+	return s.UserUrl
+}
+
+func (mastodonProvider) BaseUrlHint() string {
+	return "The URL of your instance (e.g. https://mastodon.social)"
+}
+
+func (mastodonProvider) Register(ctx *Context, a *Account) error {
+	return a.RegisterMastodonApp(ctx)
+}
+
+// Name the app is registered under, also used to recognize own posts
+const mastodonAppName = "Autosite"
+
+type mastodonAccount struct {
+	Id string `json:"id"`
+	Acct string `json:"acct"`
+	DisplayName string `json:"display_name"`
+	Url string `json:"url"`
+}
+
+type mastodonStatus struct {
+	Id string `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Url string `json:"url"`
+	Content string `json:"content"`
+	SpoilerText string `json:"spoiler_text"`
+	Application *struct {
+		Name string `json:"name"`
+	} `json:"application"`
+}
+
+// Register app with the configured instance (once per instance), setting client credentials and OAuth URLs
+func (a *Account) RegisterMastodonApp(ctx *Context) error {
+	a.BaseUrl = strings.TrimRight(a.BaseUrl, "/")
+	if a.BaseUrl == "" {
+		return errors.New("Instance URL is required")
+	}
+	if a.ConsumerKey != "" && strings.HasPrefix(a.AuthUrl, a.BaseUrl + "/") {
+		return nil
+	}
+	if a.RequestUrl == "" {
+		a.RequestUrl = "read write"
+	}
+	resp, err := ctx.Client.PostForm(a.BaseUrl + "/api/v1/apps", url.Values{
+		"client_name": {mastodonAppName},
+		"redirect_uris": {a.oauth2Config(ctx.Request).RedirectURL},
+		"scopes": {a.RequestUrl},
+		"website": {"http://" + ctx.Request.Host + "/"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var app struct {
+		ClientId string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := decodeResponse(resp, &app); err != nil {
+		return err
+	}
+	a.ConsumerKey, a.ConsumerSecret = app.ClientId, app.ClientSecret
+	a.AuthUrl, a.AccessUrl = a.BaseUrl + "/oauth/authorize", a.BaseUrl + "/oauth/token"
+	a.Token, a.RefreshToken = "", ""
+	return nil
+}
+
+// Issue authenticated API request against the instance, decoding the response JSON to data
+func (a *Account) mastodonRequest(ctx *Context, method string, path string, form url.Values, data interface{}) error {
+	var req *http.Request
+	if method == "GET" {
+		req, _ = http.NewRequest(method, a.BaseUrl + path + "?" + form.Encode(), nil)
+	} else {
+		req, _ = http.NewRequest(method, a.BaseUrl + path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer " + a.Token)
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if data == nil {
+		if resp.StatusCode != 200 {
+			p, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s %s returned status %d, %s", method, path, resp.StatusCode, p)
+		}
+		return nil
+	}
+	return decodeResponse(resp, data)
+}
+
+// Get updates from Mastodon
+func (a *Account) GetMastodonUpdates(ctx *Context) {
+	var tweets []map[string]string
+	var user mastodonAccount
+	if err := a.mastodonRequest(ctx, "GET", "/api/v1/accounts/verify_credentials", url.Values{}, &user); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " user info: " + err.Error())
+		return
+	}
+	params := url.Values{"exclude_replies": {"true"}, "exclude_reblogs": {"true"}}
+	if latest := a.Latest(ctx); latest.OriginalId > 0 {
+		params.Add("since_id", strconv.FormatInt(latest.OriginalId, 10))
+	}
+	var body json.RawMessage
+	if err := a.mastodonRequest(ctx, "GET", "/api/v1/accounts/" + url.PathEscape(user.Id) + "/statuses", params, &body); err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	items, err := decodeItems(body)
+	if err != nil {
+		ctx.Session.AddFlash("Error getting " + a.Name + " updates: " + err.Error())
+		return
+	}
+	name := user.DisplayName
+	if name == "" {
+		name = user.Acct
+	}
+	for _, item := range items {
+		var status mastodonStatus
+		if err := json.Unmarshal(item, &status); err != nil {
+			skipMalformed(a.Name, err)
+			continue
+		}
+		if status.Application != nil && status.Application.Name == mastodonAppName {
+			continue
+		}
+		id, _ := strconv.ParseInt(status.Id, 10, 64)
+		update := Status {
+			Name: a.Name,
+			OriginalId: id,
+			Heading: plainText(status.Content, 500),
+			Link: status.Url,
+			Created: status.CreatedAt,
+			User: name,
+			UserUrl: user.Url,
+		}
+		if status.SpoilerText != "" {
+			update.Heading, update.Content = status.SpoilerText, update.Heading
+		}
+		if _, fresh, _ := a.saveStatus(ctx, &update); fresh && a.RepostTarget() != "" {
+			tweets = append(tweets, map[string]string{"status": update.Heading, "link": update.Link})
+		}
+	}
+	repost(ctx, a.RepostTarget(), tweets)
+}
+
+// Post updates to Mastodon
+func (a *Account) PostMastodonUpdate(ctx *Context, posts []map[string]string) {
+	for i := 1; i <= len(posts); i++ {
+		text := []rune(posts[len(posts) - i]["status"])
+		link, ok := posts[len(posts) - i]["link"]
+		max := 500
+		if ok {
+			max -= len([]rune(link)) + 1
+		}
+		if len(text) > max {
+			if max > 3 {
+				text = append(text[:max - 3], []rune("...")...)
+			} else {
+				// Link leaves no room for the text (instances count it as 23 characters anyway)
+				text = nil
+			}
+		}
+		status := strings.TrimSpace(string(text) + " " + link)
+		if status == "" {
+			continue
+		}
+		if err := a.mastodonRequest(ctx, "POST", "/api/v1/statuses", url.Values{"status": {status}, "visibility": {"public"}}, nil); err != nil {
+			ctx.Session.AddFlash("Error posting " + a.Name + " update: " + err.Error())
+			continue
+		}
+		ctx.Session.AddFlash("Posted " + a.Name + " update '" + status + "'")
+	}
+}
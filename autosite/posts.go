@@ -0,0 +1,297 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Post struct for blog posts, published under /blog/{year}/{slug}
+ */
+
+type Post struct {
+	Title string
+	Name string
+	Format string
+	Body []byte
+	Source []byte
+	Tags string
+	Date time.Time
+	Draft bool
+	Author string
+	Timeline bool
+}
+
+// Name of the local network posts show up as on the timeline
+const postNetwork = "autosite"
+
+// Posts per page of the blog index
+const postsPerPage = 10
+
+func (p *Post) Type() string {
+	return "Post"
+}
+
+func (p *Post) BodyString() string {
+	return string(p.Body)
+}
+
+// Return body as written by the author (markdown source for markdown posts)
+func (p *Post) SourceString() string {
+	if p.IsMarkdown() {
+		return string(p.Source)
+	}
+	return string(p.Body)
+}
+
+func (p *Post) IsMarkdown() bool {
+	return p.Format == "markdown"
+}
+
+// Set body from the author's input, rendering markdown to sanitized HTML
+func (p *Post) SetBody(input string) error {
+	body, source, err := formatBody(p.Format, input)
+	if err != nil {
+		return err
+	}
+	p.Body, p.Source = body, source
+	return nil
+}
+
+// Tags as list, from the comma separated field
+func (p *Post) TagList() []string {
+	var tags []string
+	for _, tag := range strings.Split(p.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Check whether post has given tag (ignoring case)
+func (p *Post) HasTag(tag string) bool {
+	for _, t := range p.TagList() {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether post is shown to visitors at given time
+func (p *Post) Visible(now time.Time) bool {
+	return !p.Draft && !p.Date.After(now)
+}
+
+func (p *Post) Permalink() string {
+	return "/blog/" + p.Date.Format("2006") + "/" + p.Name
+}
+
+var slugMatcher = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Derive slug from title, e.g. "hello-world" for "Hello, World!"
+func slugify(title string) string {
+	return strings.Trim(slugMatcher.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+// Timeline entry for post with given key
+func (p *Post) status(key string) Status {
+	return Status{Name: postNetwork, OriginalId: feedId(key), Heading: p.Title, Content: plainText(p.BodyString(), 300), Link: p.Permalink(), Created: p.Date, User: p.Author, UserUrl: "/blog"}
+}
+
+// Add, update or remove post's timeline entry according to its settings
+func (p *Post) syncTimeline(ctx *Context, key string) {
+	update := p.status(key)
+	if p.Timeline && p.Visible(time.Now()) {
+		update.Upsert(ctx)
+		return
+	}
+	ctx.Store.Delete(ctx.Store.NamedKey(update.Type(), update.KeyName()))
+}
+
+// Put posts scheduled for the timeline on it once their date has come (run by cron along with scheduled pages)
+func announcePosts(ctx *Context) {
+	var posts []Post
+	keys, err := ctx.Store.GetAll(NewQuery("Post").Filter("Timeline =", true), &posts)
+	if err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+		return
+	}
+	now := time.Now()
+	for i := range posts {
+		if !posts[i].Visible(now) {
+			continue
+		}
+		update := posts[i].status(keys[i])
+		var stored Status
+		if ctx.Store.Get(ctx.Store.NamedKey(update.Type(), update.KeyName()), &stored) != nil {
+			update.Upsert(ctx)
+			ctx.Session.AddFlash("Announced " + posts[i].Name)
+		}
+	}
+}
+
+// All posts visible to visitors, newest first
+func visiblePosts(ctx *Context) []Post {
+	var posts, visible []Post
+	if _, err := ctx.Store.GetAll(NewQuery("Post").Filter("Draft =", false).Order("-Date"), &posts); err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+	}
+	now := time.Now()
+	for _, post := range posts {
+		if post.Visible(now) {
+			visible = append(visible, post)
+		}
+	}
+	return visible
+}
+
+// Years of given posts (newest first, as the posts)
+func postYears(posts []Post) []int {
+	var years []int
+	for _, post := range posts {
+		if year := post.Date.Year(); len(years) == 0 || years[len(years) - 1] != year {
+			years = append(years, year)
+		}
+	}
+	return years
+}
+
+// Handler: Blog index, archives by year and tag (paginated) and single posts
+func BlogHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method != "GET" {
+		return
+	}
+	var site Site
+	Get(ctx, &site)
+	if ctx.Vars["slug"] != "" {
+		var post Post
+		GetByName(ctx, &post, ctx.Vars["slug"])
+		// Signed in users may preview drafts
+		if post.Name == "" || post.Date.Format("2006") != ctx.Vars["year"] || (!post.Visible(time.Now()) && ctx.User == "") {
+			http.NotFound(w, r)
+			return
+		}
+		render(w, ctx, []string{"post"}, map[string]interface{}{"site": &site, "post": &post})
+		return
+	}
+	all := visiblePosts(ctx)
+	posts, heading, base := all, "Blog", "/blog"
+	if ctx.Vars["year"] != "" {
+		posts, heading, base = nil, "Posts from " + ctx.Vars["year"], "/blog/" + ctx.Vars["year"]
+		for _, post := range all {
+			if post.Date.Format("2006") == ctx.Vars["year"] {
+				posts = append(posts, post)
+			}
+		}
+	}
+	if ctx.Vars["tag"] != "" {
+		posts, heading, base = nil, "Posts tagged " + ctx.Vars["tag"], "/blog/tags/" + ctx.Vars["tag"]
+		for _, post := range all {
+			if post.HasTag(ctx.Vars["tag"]) {
+				posts = append(posts, post)
+			}
+		}
+	}
+	current := 1
+	if ctx.Vars["page"] != "" {
+		current, _ = strconv.Atoi(ctx.Vars["page"])
+	}
+	start := (current - 1) * postsPerPage
+	if current < 1 || (start >= len(posts) && current > 1) {
+		http.NotFound(w, r)
+		return
+	}
+	data := map[string]interface{}{"site": &site, "heading": heading, "years": postYears(all)}
+	if start + postsPerPage < len(posts) {
+		data["next"] = base + "/page/" + strconv.Itoa(current + 1)
+		posts = posts[start:start + postsPerPage]
+	} else {
+		posts = posts[start:]
+	}
+	if current == 2 {
+		data["previous"] = base
+	} else if current > 2 {
+		data["previous"] = base + "/page/" + strconv.Itoa(current - 1)
+	}
+	data["posts"] = posts
+	render(w, ctx, []string{"blog"}, data)
+}
+
+
+/*
+ * Admin area for posts
+ */
+
+// Handler: List (GET), create (POST) and update (PUT) posts, and delete them (DELETE /manage/posts/{slug})
+func PostsHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	var post Post
+	switch ctx.Method {
+		case "POST", "PUT":
+			var stored Post
+			key := r.FormValue("Key")
+			if ctx.Method == "PUT" && GetByKey(ctx, &stored, key) == "" {
+				http.NotFound(w, r)
+				return
+			}
+			Build(&post, r)
+			post.Author = stored.Author
+			if post.Author == "" {
+				post.Author = ctx.User
+			}
+			if post.Name == "" {
+				post.Name = slugify(post.Title)
+			}
+			if post.Date.IsZero() {
+				post.Date = time.Now()
+			}
+			if err := post.SetBody(r.FormValue("Body")); err != nil {
+				ctx.Session.AddFlash("Error rendering markdown: " + err.Error())
+			} else if other := postKey(ctx, post.Name); post.Name == "" || (other != "" && other != key) {
+				ctx.Session.AddFlash("Please pick a title or slug that is not taken by another post")
+			} else if ctx.Method == "POST" {
+				if key = Save(ctx, &post); key != "" {
+					post.syncTimeline(ctx, key)
+				}
+			} else {
+				var saved bool
+				if key, saved = updateModel(ctx, &post, key); saved {
+					post.syncTimeline(ctx, key)
+				}
+			}
+			render(w, ctx, []string{"manage","posts","edit"}, map[string]interface{}{"key": key, "content": &post})
+			return
+		case "DELETE":
+			key := GetByName(ctx, &post, ctx.Vars["slug"])
+			if key != "" {
+				Delete(ctx, key)
+				post.Timeline = false
+				post.syncTimeline(ctx, key)
+			}
+			return
+	}
+	var posts []Post
+	ctx.Store.GetAll(NewQuery("Post").Order("-Date"), &posts)
+	render(w, ctx, []string{"manage","posts"}, map[string]interface{}{"content": &posts})
+}
+
+// Key of the post with given slug, if any
+func postKey(ctx *Context, slug string) string {
+	keys, _ := ctx.Store.GetAll(NewQuery("Post").Filter("Name =", slug).Limit(1), nil)
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
@@ -0,0 +1,153 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"strings"
+	"sync"
+)
+
+
+/*
+ * Network providers (registered by name, looked up for every account)
+ */
+
+// A network the timeline can be fed from
+type Provider interface {
+	// Account name and URL slug, e.g. "twitter"
+	Name() string
+	// Name shown in the admin area
+	Title() string
+	// OAuth version used for authorization (1 or 2, 0 for none)
+	Version() int
+	// Account holding the default request URL (or scope), authorize and access URLs
+	Defaults() Account
+	// Save new updates as Status entries
+	FetchUpdates(ctx *Context, a *Account)
+}
+
+// Optional Provider extension for networks updates can be posted to
+type Poster interface {
+	PostUpdates(ctx *Context, a *Account, posts []map[string]string)
+}
+
+// Optional Provider extension for networks reached at a configurable URL (feeds, self-hosted instances)
+type BaseUrlProvider interface {
+	BaseUrlHint() string
+}
+
+// Optional Provider extension for networks authorized with an access token entered in the admin area
+type TokenProvider interface {
+	TokenHint() string
+}
+
+// Optional Provider extension for networks clients register with before authorizing (e.g. per Mastodon instance)
+type Registrar interface {
+	Register(ctx *Context, a *Account) error
+}
+
+// Optional Provider extension for networks pushing updates to /hooks/{name}
+type WebhookProvider interface {
+	// Verify request with the account's webhook secret and save its updates, returning the HTTP status
+	ServeWebhook(ctx *Context, a *Account, body []byte) int
+}
+
+// Optional Provider extension for networks without a homepage at http://<name>.com
+type HomepageProvider interface {
+	Homepage(s *Status) string
+}
+
+// Optional Provider extension for networks set up more than once, as further accounts named "<name>-<instance>" (e.g. "feed-letterboxd")
+type MultiAccountProvider interface {
+	MultiAccount() bool
+}
+
+var registry struct {
+	sync.RWMutex
+	names []string
+	providers map[string]Provider
+}
+
+func init() {
+	RegisterProvider(twitterProvider{})
+	RegisterProvider(mastodonProvider{})
+	RegisterProvider(githubProvider{})
+	RegisterProvider(gitlabProvider{})
+	RegisterProvider(giteaProvider{})
+	RegisterProvider(linkedInProvider{})
+	RegisterProvider(xingProvider{})
+	RegisterProvider(feedProvider{})
+}
+
+// Add provider to the registry, replacing any provider of the same name
+func RegisterProvider(p Provider) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.providers == nil {
+		registry.providers = map[string]Provider{}
+	}
+	if _, ok := registry.providers[p.Name()]; !ok {
+		registry.names = append(registry.names, p.Name())
+	}
+	registry.providers[p.Name()] = p
+}
+
+// Return provider registered under name, or nil
+func LookupProvider(name string) Provider {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.providers[name]
+}
+
+// Return provider for account (or its updates) of given name, including further accounts of multi-account providers, or nil
+func AccountProvider(name string) Provider {
+	if p := LookupProvider(name); p != nil {
+		return p
+	}
+	if i := strings.Index(name, "-"); i > 0 {
+		p := LookupProvider(name[:i])
+		if m, ok := p.(MultiAccountProvider); ok && m.MultiAccount() {
+			return p
+		}
+	}
+	return nil
+}
+
+// Return all providers in order of registration
+func Providers() []Provider {
+	registry.RLock()
+	defer registry.RUnlock()
+	providers := make([]Provider, len(registry.names))
+	for i, name := range registry.names {
+		providers[i] = registry.providers[name]
+	}
+	return providers
+}
+
+// Return providers updates can be posted to
+func Posters() []Provider {
+	var posters []Provider
+	for _, p := range Providers() {
+		if _, ok := p.(Poster); ok {
+			posters = append(posters, p)
+		}
+	}
+	return posters
+}
+
+// Post updates via the account registered under target, if its provider supports posting
+func repost(ctx *Context, target string, posts []map[string]string) {
+	poster, ok := LookupProvider(target).(Poster)
+	if target == "" || !ok || len(posts) == 0 {
+		return
+	}
+	var account Account
+	if GetByName(ctx, &account, target) != "" && account.Verified() {
+		poster.PostUpdates(ctx, &account, posts)
+	}
+}
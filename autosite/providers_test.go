@@ -0,0 +1,491 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+/*
+ * Provider parsers against recorded responses in testdata/
+ */
+
+// Load recorded response
+func fixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func date(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Compare the fields the timeline shows
+func assertStatuses(t *testing.T, got []parsedStatus, want []Status) {
+	if len(got) != len(want) {
+		t.Errorf("got %d updates, want %d", len(got), len(want))
+	}
+	for i := 0; i < len(got) && i < len(want); i++ {
+		g, w := got[i].Status, want[i]
+		if g.Name != w.Name || g.OriginalId != w.OriginalId || g.Heading != w.Heading || g.Link != w.Link || g.Content != w.Content || !g.Created.Equal(w.Created) {
+			t.Errorf("update %d:\n got  %+v\n want %+v", i, g, w)
+		}
+		if w.User != "" && (g.User != w.User || g.UserUrl != w.UserUrl) {
+			t.Errorf("update %d: got user %q (%s), want %q (%s)", i, g.User, g.UserUrl, w.User, w.UserUrl)
+		}
+	}
+}
+
+func TestParseTwitterTimeline(t *testing.T) {
+	got, err := parseTwitterTimeline(fixture(t, "twitter_timeline.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(t, got, []Status{
+		{Name: "twitter", OriginalId: 440927342562099200, Heading: "Finally moved the site to the new server", Link: "http://t.co/AbC123", Created: date("2014-03-04T18:12:35Z"), User: "paceline", UserUrl: "https://twitter.com/paceline"},
+		{Name: "twitter", OriginalId: 440256000000000000, Heading: "Sunday ride done, 80k in the rain", Created: date("2014-03-02T21:45:00Z"), User: "paceline", UserUrl: "https://twitter.com/paceline"},
+	})
+}
+
+func TestParseXingFeed(t *testing.T) {
+	got, err := parseXingFeed(fixture(t, "xing_feed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(t, got, []Status{
+		{Name: "xing", OriginalId: 1393928100, Heading: "Looking for a Go developer to join our team", Created: date("2014-03-04T10:15:00Z"), User: "Ulf Möhring", UserUrl: "https://www.xing.com/profile/Ulf_Moehring"},
+		{Name: "xing", OriginalId: 1393837200, Heading: "posted an event", Content: "Go Meetup Hamburg", Link: "https://www.xing.com/events/go-meetup-hamburg-123", Created: date("2014-03-03T09:00:00Z")},
+		{Name: "xing", OriginalId: 1393747200, Heading: "posted a job", Content: "Senior Go Engineer", Link: "https://www.xing.com/jobs/senior-go-engineer-456", Created: date("2014-03-02T08:00:00Z")},
+		{Name: "xing", OriginalId: 1393657200, Heading: "posted to the thread", Content: "App Engine vs. VPS", Link: "https://www.xing.com/communities/posts/app-engine-vs-vps-789", Created: date("2014-03-01T07:00:00Z")},
+		{Name: "xing", OriginalId: 1393567200, Heading: "shared a bookmark", Content: "Effective Go", Link: "http://golang.org/doc/effective_go.html", Created: date("2014-02-28T06:00:00Z")},
+	})
+	if got[0].Repost["status"] != "Looking for a Go developer to join our team" {
+		t.Errorf("got repost %v", got[0].Repost)
+	}
+	if got[1].Repost["status"] != "I posted an event: Go Meetup Hamburg" || got[1].Repost["link"] != "https://www.xing.com/events/go-meetup-hamburg-123" {
+		t.Errorf("got repost %v", got[1].Repost)
+	}
+}
+
+func TestParseGithubEvents(t *testing.T) {
+	got, err := parseGithubEvents(fixture(t, "github_events.json"), "paceline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := "https://github.com/paceline/autosite-go"
+	assertStatuses(t, got, []Status{
+		{Name: "github", OriginalId: 1001, Heading: "commented", Content: "Nice catch", Link: repo + "/commit/abc#commitcomment-1", Created: date("2014-03-20T12:00:00Z"), User: "paceline", UserUrl: "https://github.com/paceline"},
+		{Name: "github", OriginalId: 1002, Heading: "commented", Content: "Rename this", Link: repo + "/pull/3#discussion_r1", Created: date("2014-03-19T12:00:00Z")},
+		{Name: "github", OriginalId: 1003, Heading: "created repository paceline/autosite-go", Link: repo, Created: date("2014-03-18T12:00:00Z")},
+		{Name: "github", OriginalId: 1004, Heading: "created branch feature-x", Link: repo, Created: date("2014-03-17T12:00:00Z")},
+		{Name: "github", OriginalId: 1005, Heading: "deleted branch", Link: repo, Created: date("2014-03-16T12:00:00Z")},
+		{Name: "github", OriginalId: 1006, Heading: "uploaded autosite-0.1.tar.gz", Link: "https://github.com/downloads/paceline/autosite-go/autosite-0.1.tar.gz", Created: date("2014-03-15T12:00:00Z")},
+		{Name: "github", OriginalId: 1007, Heading: "is now following garyburd", Link: "https://github.com/garyburd", Created: date("2014-03-14T12:00:00Z")},
+		{Name: "github", OriginalId: 1008, Heading: "forked paceline/autosite-go", Link: repo, Created: date("2014-03-13T12:00:00Z")},
+		{Name: "github", OriginalId: 1009, Heading: "applied fork to master", Link: repo, Created: date("2014-03-12T12:00:00Z")},
+		{Name: "github", OriginalId: 1010, Heading: "created OAuth2 example", Link: "https://gist.github.com/1", Created: date("2014-03-11T12:00:00Z")},
+		{Name: "github", OriginalId: 1011, Heading: "edited page", Content: "Home", Link: repo + "/wiki/Home", Created: date("2014-03-10T12:00:00Z")},
+		{Name: "github", OriginalId: 1012, Heading: "created on issue #7", Content: "Fixed in master", Link: repo + "/issues/7", Created: date("2014-03-09T12:00:00Z")},
+		{Name: "github", OriginalId: 1013, Heading: "opened issue #8", Content: "Refresh panics on new event types", Link: repo + "/issues/8", Created: date("2014-03-08T12:00:00Z")},
+		{Name: "github", OriginalId: 1014, Heading: "added octocat to paceline/autosite-go", Link: "https://github.com/octocat", Created: date("2014-03-07T12:00:00Z")},
+		{Name: "github", OriginalId: 1015, Heading: "Open sourced paceline/autosite-go", Link: repo, Created: date("2014-03-06T12:00:00Z")},
+		{Name: "github", OriginalId: 1016, Heading: "closed pull request", Content: "Typed structs", Link: repo + "/pull/3", Created: date("2014-03-05T12:00:00Z")},
+		{Name: "github", OriginalId: 1017, Heading: "pushed to paceline/autosite-go", Content: "Add fixture tests", Link: repo, Created: date("2014-03-04T12:00:00Z")},
+		{Name: "github", OriginalId: 1018, Heading: "added octocat to Owners", Link: "https://github.com/octocat", Created: date("2014-03-03T12:00:00Z")},
+		{Name: "github", OriginalId: 1019, Heading: "started watching paceline/autosite-go", Link: repo, Created: date("2014-03-02T12:00:00Z")},
+	})
+	for _, update := range got {
+		if (update.Repost != nil) != (update.OriginalId == 1017) {
+			t.Errorf("update %d: got repost %v", update.OriginalId, update.Repost)
+		}
+	}
+	if len(got) > 16 && got[16].Repost["status"] != "I updated my app #autositego on @github: Add fixture tests" {
+		t.Errorf("got repost %v", got[16].Repost)
+	}
+}
+
+// Push delivered by webhook is replaced by the same event once polled, and not saved again if delivered after that
+func TestGithubWebhookKey(t *testing.T) {
+	polled, err := parseGithubEvents(fixture(t, "github_events.json"), "paceline")
+	if err != nil || len(polled) < 17 {
+		t.Fatalf("got %d updates, error %v", len(polled), err)
+	}
+	body := []byte(`{"ref": "refs/heads/master", "after": "abc", "commits": [{"id": "abc", "message": "Add fixture tests"}], "repository": {"full_name": "paceline/autosite-go", "pushed_at": 1393934405}, "sender": {"login": "paceline"}}`)
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(body)
+	r := httptest.NewRequest("POST", "/hooks/github", bytes.NewReader(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature-256", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	ctx := &Context{Store: NewMemoryStore(), Request: r, Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	account := Account{Name: "github", WebhookSecret: "hook-secret", LatestUser: "octocat", LatestCreated: date("2014-03-01T12:00:00Z")}
+	account.ServeGithubWebhook(ctx, body)
+	if n, _ := ctx.Store.Count(NewQuery("Status")); n != 0 {
+		t.Fatal("saved push by someone other than the account owner")
+	}
+	account.LatestUser = "paceline"
+	for i := 0; i < 2; i++ {
+		// Redeliveries replace the delivery saved before
+		if status := account.ServeGithubWebhook(ctx, body); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+	}
+	var delivered []Status
+	ctx.Store.GetAll(NewQuery("Status"), &delivered)
+	if len(delivered) != 1 || delivered[0].Guid != polled[16].Guid || !delivered[0].Created.Equal(date("2014-03-04T12:00:05Z")) || delivered[0].Heading != polled[16].Heading {
+		t.Fatalf("got %+v, want delivery of %+v", delivered, polled[16].Status)
+	}
+	
+	// Polling the push saves it under the event id instead, without reposting it again
+	replaceDeliveries(ctx, polled)
+	if polled[16].Repost != nil {
+		t.Error("delivered push is reposted again")
+	}
+	account.saveStatuses(ctx, polled[16:17], account.LatestCreated)
+	var stored []Status
+	keys, _ := ctx.Store.GetAll(NewQuery("Status"), &stored)
+	if len(keys) != 1 || keys[0] != ctx.Store.NamedKey("Status", "github-1017") {
+		t.Fatalf("got %v, want the polled push only", keys)
+	}
+	if status := account.ServeGithubWebhook(ctx, body); status != http.StatusOK {
+		t.Errorf("delivery after polling: got status %d", status)
+	}
+	if n, _ := ctx.Store.Count(NewQuery("Status")); n != 1 {
+		t.Errorf("got %d updates after delivery of polled push", n)
+	}
+	
+	// Repeated actions on the same thing stay apart
+	later := polled[16].Status
+	later.OriginalId, later.Created = 2017, later.Created.Add(time.Hour)
+	if same, _ := sameEvent(ctx, &later); len(same) != 0 {
+		t.Errorf("same push an hour later matches %v", same)
+	}
+}
+
+// Sends requests for any host to the test server instead
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(t.server.URL)
+	r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Webhook deliveries leave the polling mark alone, so polling still picks up events the webhook never sees
+func TestGithubWebhookThenPoll(t *testing.T) {
+	store := NewMemoryStore()
+	defer func(storage func(r *http.Request) Store) { Storage = storage }(Storage)
+	Storage = func(r *http.Request) Store { return store }
+	account := Account{Name: "github", Token: "token", WebhookSecret: "hook-secret", LatestId: 900, LatestUser: "paceline", LatestCreated: date("2014-03-01T12:00:00Z")}
+	if _, err := store.Put("Account", "", &account); err != nil {
+		t.Fatal(err)
+	}
+	
+	// Newer push delivered by the webhook
+	body := []byte(`{"ref": "refs/heads/master", "after": "abc", "commits": [{"id": "abc", "message": "Add fixture tests"}], "repository": {"full_name": "paceline/autosite-go", "pushed_at": 1393934405}, "sender": {"login": "paceline"}}`)
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write(body)
+	r := httptest.NewRequest("POST", "/hooks/github", bytes.NewReader(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature-256", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/hooks/{provider}", WebhookHandler)
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("webhook: got status %d", w.Code)
+	}
+	
+	// Poll returning an older event the webhook does not deliver
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"login": "paceline"}`))
+		case "/users/paceline/events":
+			w.Write([]byte(`[{"id": "1003", "type": "CreateEvent", "actor": {"login": "paceline"}, "repo": {"name": "paceline/autosite-go"}, "payload": {"ref": null, "ref_type": "repository"}, "created_at": "2014-03-02T12:00:00Z"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	ctx := &Context{Store: store, Client: &http.Client{Transport: redirectTransport{server}}, Request: httptest.NewRequest("GET", "/manage/refresh", nil), Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	GetByName(ctx, &account, "github")
+	if !account.LatestCreated.Equal(date("2014-03-01T12:00:00Z")) {
+		t.Fatalf("webhook moved the mark to %v", account.LatestCreated)
+	}
+	account.GetGithubUpdates(ctx)
+	var stored []Status
+	store.GetAll(NewQuery("Status").Filter("Name =", "github").Order("-Created"), &stored)
+	if len(stored) != 2 || stored[1].Heading != "created repository paceline/autosite-go" {
+		t.Errorf("got %+v, want the pushed and the created update", stored)
+	}
+}
+
+func TestParseLinkedInUpdates(t *testing.T) {
+	got, err := parseLinkedInUpdates(fixture(t, "linkedin_updates.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := "http://www.linkedin.com/profile/view?id=123"
+	assertStatuses(t, got, []Status{
+		{Name: "linkedin", OriginalId: 1393929300000, Heading: "Great read on Go concurrency patterns", Content: "http://blog.golang.org/pipelines", Link: "http://blog.golang.org/pipelines", Created: date("2014-03-04T10:35:00Z"), User: "Ulf Möhring", UserUrl: profile},
+		{Name: "linkedin", OriginalId: 1393842900000, Heading: "shared a link", Content: "http://moehring.me", Link: "http://moehring.me", Created: date("2014-03-03T10:35:00Z")},
+		{Name: "linkedin", OriginalId: 1393756500000, Heading: "Now on autosite-go", Created: date("2014-03-02T10:35:00Z")},
+	})
+	if got[1].Repost["status"] != "I shared a link" || got[2].Repost["link"] != profile {
+		t.Errorf("got reposts %v, %v", got[1].Repost, got[2].Repost)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	if _, err := parseGithubEvents([]byte(`{"message": "Not Found"}`), "paceline"); err == nil {
+		t.Error("expected error for non-array response")
+	}
+	if _, err := parseXingFeed([]byte(`[]`)); err == nil {
+		t.Error("expected error for non-object response")
+	}
+}
+
+// Ids beyond 2^53 stay exact, whether sent as number or string
+func TestFlexInt(t *testing.T) {
+	for value, want := range map[string]flexInt{`9007199254740993`: 9007199254740993, `"1234567890123456789"`: 1234567890123456789, `1.5e3`: 1500, `null`: 0} {
+		var got flexInt
+		if err := json.Unmarshal([]byte(value), &got); err != nil || got != want {
+			t.Errorf("%s: got %d (error %v), want %d", value, got, err, want)
+		}
+	}
+}
+
+
+/*
+ * Self-hosted forges against a local server
+ */
+
+// Serve fixed responses by path, counting requests per path
+func forgeServer(t *testing.T, token string, responses map[string][]byte) (*httptest.Server, map[string]int) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != token && r.Header.Get("Authorization") != "token " + token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	return server, requests
+}
+
+// Saved updates, newest first
+func forgeStatuses(ctx *Context, name string) []parsedStatus {
+	var stored []Status
+	ctx.Store.GetAll(NewQuery("Status").Filter("Name =", name).Order("-Created"), &stored)
+	got := make([]parsedStatus, len(stored))
+	for i := range stored {
+		got[i].Status = stored[i]
+	}
+	return got
+}
+
+func TestGetGitlabUpdates(t *testing.T) {
+	server, requests := forgeServer(t, "gl-token", map[string][]byte{
+		"/api/v4/user": []byte(`{"id": 2, "username": "paceline", "name": "Ulf Möhring", "web_url": "https://gitlab.example.com/paceline"}`),
+		"/api/v4/users/2/events": fixture(t, "gitlab_events.json"),
+		"/api/v4/projects/10": []byte(`{"id": 10, "path_with_namespace": "paceline/autosite-go", "web_url": "https://gitlab.example.com/paceline/autosite-go"}`),
+		"/api/v4/projects/11": []byte(`{"id": 11, "path_with_namespace": "paceline/goauth2", "web_url": "https://gitlab.example.com/paceline/goauth2"}`),
+		"/api/v4/projects/12": []byte(`{"id": 12, "path_with_namespace": "paceline/new-project", "web_url": "https://gitlab.example.com/paceline/new-project"}`),
+	})
+	defer server.Close()
+	ctx := &Context{Store: NewMemoryStore(), Client: server.Client(), Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	account := Account{Name: "gitlab", BaseUrl: server.URL, Token: "gl-token"}
+	account.GetGitlabUpdates(ctx)
+	for _, flash := range ctx.Session.Flashes() {
+		if strings.HasPrefix(flash.(string), "Error") {
+			t.Error(flash)
+		}
+	}
+	repo, other := "https://gitlab.example.com/paceline/autosite-go", "https://gitlab.example.com/paceline/goauth2"
+	// The malformed event 2006 and unsupported event 2009 are skipped
+	assertStatuses(t, forgeStatuses(ctx, "gitlab"), []Status{
+		{Name: "gitlab", OriginalId: 2001, Heading: "pushed to paceline/autosite-go", Content: "Add forge tests", Link: repo, Created: date("2014-03-20T12:00:00Z"), User: "paceline", UserUrl: "https://gitlab.example.com/paceline"},
+		{Name: "gitlab", OriginalId: 2002, Heading: "created tag v0.2", Link: repo, Created: date("2014-03-19T12:00:00Z")},
+		{Name: "gitlab", OriginalId: 2003, Heading: "deleted branch", Link: repo, Created: date("2014-03-18T12:00:00Z")},
+		{Name: "gitlab", OriginalId: 2004, Heading: "accepted merge request", Content: "Typed structs", Link: other + "/-/merge_requests/3", Created: date("2014-03-17T12:00:00Z")},
+		{Name: "gitlab", OriginalId: 2005, Heading: "opened issue #7", Content: "Refresh panics on new event types", Link: repo + "/-/issues/7", Created: date("2014-03-16T12:00:00Z")},
+		{Name: "gitlab", OriginalId: 2007, Heading: "commented", Content: "Nice catch", Link: other + "/-/merge_requests/3", Created: date("2014-03-14T12:00:00Z")},
+		{Name: "gitlab", OriginalId: 2008, Heading: "created repository paceline/new-project", Link: "https://gitlab.example.com/paceline/new-project", Created: date("2014-03-13T12:00:00Z")},
+	})
+	// Each project is looked up once, however many events are about it
+	for _, path := range []string{"/api/v4/projects/10", "/api/v4/projects/11", "/api/v4/projects/12"} {
+		if requests[path] != 1 {
+			t.Errorf("%s: got %d requests, want 1", path, requests[path])
+		}
+	}
+}
+
+func TestGetGiteaUpdates(t *testing.T) {
+	server, _ := forgeServer(t, "gt-token", map[string][]byte{
+		"/api/v1/user": []byte(`{"id": 2, "login": "paceline"}`),
+		"/api/v1/users/paceline/activities/feeds": fixture(t, "gitea_activities.json"),
+	})
+	defer server.Close()
+	ctx := &Context{Store: NewMemoryStore(), Client: server.Client(), Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	account := Account{Name: "gitea", BaseUrl: server.URL, Token: "gt-token"}
+	account.GetGiteaUpdates(ctx)
+	repo := "https://codeberg.org/paceline/autosite-go"
+	// The malformed activity 3006 and unsupported op type of 3010 are skipped
+	assertStatuses(t, forgeStatuses(ctx, "gitea"), []Status{
+		{Name: "gitea", OriginalId: 3001, Heading: "pushed to paceline/autosite-go", Content: "Add forge tests", Link: repo, Created: date("2014-03-20T12:00:00Z"), User: "paceline", UserUrl: server.URL + "/paceline"},
+		{Name: "gitea", OriginalId: 3002, Heading: "created tag v0.2", Link: repo, Created: date("2014-03-19T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3003, Heading: "deleted branch", Link: repo, Created: date("2014-03-18T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3004, Heading: "merged pull request", Content: "Typed structs", Link: repo + "/pulls/3", Created: date("2014-03-17T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3005, Heading: "opened issue #7", Content: "Refresh panics on new event types", Link: repo + "/issues/7", Created: date("2014-03-16T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3007, Heading: "closed issue #7", Content: "Refresh panics on new event types", Link: repo + "/issues/7", Created: date("2014-03-15T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3008, Heading: "commented", Content: "Nice catch", Link: repo + "/pulls/3", Created: date("2014-03-14T12:00:00Z")},
+		{Name: "gitea", OriginalId: 3009, Heading: "created repository paceline/new-project", Link: "https://codeberg.org/paceline/new-project", Created: date("2014-03-13T12:00:00Z")},
+	})
+}
+
+// Op types map like the events they stand for, whatever the activity says
+func TestGiteaOpTypes(t *testing.T) {
+	for opType, want := range map[string]string{
+		"commit_repo": "push",
+		"mirror_sync_push": "push",
+		"push_tag": "tag created",
+		"mirror_sync_create": "tag created",
+		"delete_tag": "tag deleted",
+		"mirror_sync_delete": "tag deleted",
+		"delete_branch": "branch deleted",
+		"create_repo": "repository",
+		"create_issue": "issue opened",
+		"close_issue": "issue closed",
+		"reopen_issue": "issue reopened",
+		"create_pull_request": "merge_request opened",
+		"close_pull_request": "merge_request closed",
+		"reopen_pull_request": "merge_request reopened",
+		"merge_pull_request": "merge_request merged",
+		"auto_merge_pull_request": "merge_request merged",
+		"comment_issue": "comment",
+		"comment_pull": "comment",
+		"star_repo": "",
+		"transfer_repo": "",
+	} {
+		ga := giteaActivity{OpType: opType, Content: "1|Title"}
+		e := ga.forgeEvent()
+		if got := strings.TrimSpace(e.Kind + " " + e.Action); got != want {
+			t.Errorf("%s: got %q, want %q", opType, got, want)
+		}
+	}
+}
+
+/*
+ * Crossposting to Twitter against a local server
+ */
+
+func TestPostTwitterUpdate(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/statuses/update.json" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		mu.Lock()
+		posted = append(posted, r.PostForm.Get("status"))
+		mu.Unlock()
+		w.Write([]byte(`{"id_str": "1"}`))
+	}))
+	defer server.Close()
+	defer func(api string) { twitterAPI = api }(twitterAPI)
+	twitterAPI = server.URL
+
+	ctx := &Context{Client: server.Client(), Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	account := Account{Name: "twitter", ConsumerKey: "key", ConsumerSecret: "secret", Token: "token", Secret: "token-secret"}
+	account.PostTwitterUpdate(ctx, []map[string]string{
+		{"status": "I updated my app #autositego on @github: Add fixture tests", "link": "https://github.com/paceline/autosite-go"},
+		{"status": strings.Repeat("a", 130)},
+	})
+
+	// Oldest first, long updates shortened to leave room for the link
+	want := []string{strings.Repeat("a", 115) + "...", "I updated my app #autositego on @github: Add fixture tests https://github.com/paceline/autosite-go"}
+	if len(posted) != len(want) {
+		t.Fatalf("got %d posts, want %d: %q", len(posted), len(want), posted)
+	}
+	for i := range want {
+		if posted[i] != want[i] {
+			t.Errorf("post %d: got %q, want %q", i, posted[i], want[i])
+		}
+	}
+}
+
+// Long links leave no room for the text, empty updates are not posted
+func TestPostMastodonUpdate(t *testing.T) {
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/statuses" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		posted = append(posted, r.PostForm.Get("status"))
+	}))
+	defer server.Close()
+
+	ctx := &Context{Client: server.Client(), Session: sessions.NewSession(sessions.NewCookieStore(randomKey(32)), sessionName)}
+	account := Account{Name: "mastodon", BaseUrl: server.URL, Token: "token"}
+	long := "https://example.com/" + strings.Repeat("a", 480)
+	account.PostMastodonUpdate(ctx, []map[string]string{
+		{"status": ""},
+		{"status": "", "link": "https://example.com/"},
+		{"status": "Too long to fit", "link": long},
+		{"status": strings.Repeat("a", 600)},
+	})
+
+	want := []string{strings.Repeat("a", 497) + "...", long, "https://example.com/"}
+	if len(posted) != len(want) {
+		t.Fatalf("got %d posts, want %d: %q", len(posted), len(want), posted)
+	}
+	for i := range want {
+		if posted[i] != want[i] {
+			t.Errorf("post %d: got %q, want %q", i, posted[i], want[i])
+		}
+	}
+}
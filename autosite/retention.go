@@ -0,0 +1,193 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+
+/*
+ * Timeline retention (per network, by count or age) and archive of expired updates
+ */
+
+// Updates kept per network by accounts without a retention setting
+const defaultRetentionLimit = 100
+
+// Expired update, moved out of the timeline
+type Archive Status
+
+func (a *Archive) Type() string {
+	return "Archive"
+}
+
+// Retention policy ("count", "age" in days or "unlimited") and its limit
+func (a *Account) RetentionPolicy() (string, int) {
+	switch a.Retention {
+		case "":
+			return "count", defaultRetentionLimit
+		case "count", "age":
+			if a.RetentionLimit > 0 {
+				return a.Retention, a.RetentionLimit
+			}
+	}
+	return "unlimited", 0
+}
+
+// Returned for retention by count or age without a limit, which would otherwise keep everything
+var errRetentionLimit = errors.New("Please enter a number greater than 0 to keep updates by count or age")
+
+// Check retention setting submitted in the networks form
+func (a *Account) checkRetention() error {
+	if (a.Retention == "count" || a.Retention == "age") && a.RetentionLimit <= 0 {
+		return errRetentionLimit
+	}
+	return nil
+}
+
+// Remove updates beyond the account's retention limit from the timeline, archiving them if set up to
+func (a *Account) expireStatuses(ctx *Context) {
+	q := NewQuery("Status").Filter("Name =", a.Name)
+	switch policy, limit := a.RetentionPolicy(); policy {
+		case "count":
+			q = q.Order("-Created").Offset(limit)
+		case "age":
+			q = q.Filter("Created <", time.Now().AddDate(0, 0, -limit)).Order("-Created")
+		default:
+			return
+	}
+	var expired []Status
+	keys, err := ctx.Store.GetAll(q, &expired)
+	if err != nil {
+		ctx.Session.AddFlash("Error expiring " + a.Name + " updates: " + err.Error())
+		return
+	}
+	for i, key := range keys {
+		if a.KeepArchive {
+			if err := expired[i].archive(ctx); err != nil {
+				ctx.Session.AddFlash("Error archiving " + a.Name + " update: " + err.Error())
+				continue
+			}
+		}
+		ctx.Store.Delete(key)
+	}
+}
+
+// Newest update fetched so far, remembered even once it expired from the timeline
+func (a *Account) Latest(ctx *Context) Status {
+	if a.LatestCreated.IsZero() {
+		// Accounts last refreshed before the mark was kept
+		return Latest(ctx, a.Name)
+	}
+	return Status{Name: a.Name, OriginalId: a.LatestId, Guid: a.LatestGuid, Created: a.LatestCreated, User: a.LatestUser}
+}
+
+// Returned by saveStatus for updates no newer than the mark, which were fetched before
+var errSeenStatus = errors.New("autosite: update was fetched before")
+
+// Save fetched update unless it is no newer than the mark (seen before, and maybe expired since). Reports whether it is new, and errSeenStatus if it was skipped.
+func (a *Account) saveStatus(ctx *Context, s *Status) (string, bool, error) {
+	if !a.LatestCreated.IsZero() && !s.Created.After(a.LatestCreated) {
+		return "", false, errSeenStatus
+	}
+	key, fresh := s.Upsert(ctx)
+	if key == "" {
+		return "", false, errors.New("autosite: could not save " + s.Name + " update")
+	}
+	if s.Created.After(a.newest.Created) {
+		a.newest = *s
+	}
+	return key, fresh, nil
+}
+
+// Move the mark to the newest update saved since, reporting whether the account needs saving
+func (a *Account) advanceLatest() bool {
+	if !a.newest.Created.After(a.LatestCreated) {
+		return false
+	}
+	a.LatestId, a.LatestGuid, a.LatestCreated, a.LatestUser = a.newest.OriginalId, a.newest.Guid, a.newest.Created, a.newest.User
+	return true
+}
+
+// Expire updates of every network on the timeline, by the default policy for those without an account (e.g. blog posts, or deleted accounts)
+func expireTimeline(ctx *Context, accounts []Account) {
+	byName := make(map[string]*Account)
+	for i := range accounts {
+		byName[accounts[i].Name] = &accounts[i]
+	}
+	for _, name := range timelineNetworks(ctx) {
+		a, ok := byName[name]
+		if !ok {
+			a = &Account{Name: name}
+		}
+		a.expireStatuses(ctx)
+	}
+}
+
+// Names of networks with updates on the timeline, looked up one after the other (not every backend can query distinct values)
+func timelineNetworks(ctx *Context) []string {
+	var names []string
+	q := NewQuery("Status").Order("Name").Limit(1)
+	for {
+		var next []Status
+		if _, err := ctx.Store.GetAll(q, &next); err != nil || len(next) == 0 {
+			return names
+		}
+		names = append(names, next[0].Name)
+		q = NewQuery("Status").Filter("Name >", next[0].Name).Order("Name").Limit(1)
+	}
+}
+
+// Copy update to the archive (under the same key name, so archiving it twice does not duplicate it)
+func (s *Status) archive(ctx *Context) error {
+	archived := Archive(*s)
+	var key string
+	if s.KeyName() != "" {
+		key = ctx.Store.NamedKey(archived.Type(), s.KeyName())
+	}
+	_, err := ctx.Store.Put(archived.Type(), key, &archived)
+	return err
+}
+
+// Archived updates of given month, newest first
+func Archived(ctx *Context, month time.Time) []*Status {
+	q := NewQuery("Archive").Filter("Created >=", month).Filter("Created <", month.AddDate(0, 1, 0)).Order("-Created")
+	var archived []Archive
+	if _, err := ctx.Store.GetAll(q, &archived); err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+	}
+	timeline := make([]*Status, len(archived))
+	for i := range archived {
+		s := Status(archived[i])
+		timeline[i] = &s
+	}
+	return timeline
+}
+
+// Handler: Browse archived updates by month
+func ArchiveHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method == "GET" {
+		year, _ := strconv.Atoi(ctx.Vars["year"])
+		month, _ := strconv.Atoi(ctx.Vars["month"])
+		if month < 1 || month > 12 {
+			http.NotFound(w, r)
+			return
+		}
+		var site Site
+		Get(ctx, &site)
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		data := map[string]interface{}{"site": &site, "timeline": Archived(ctx, start), "month": start, "previous": start.AddDate(0, -1, 0)}
+		if next := start.AddDate(0, 1, 0); next.Before(time.Now()) {
+			data["next"] = next
+		}
+		render(w, ctx, []string{"archive"}, data)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Page revisions (an immutable copy of every saved version of a page)
+ */
+
+type Revision struct {
+	PageKey string
+	Author string
+	Created time.Time
+	Title string
+	Name string
+	Format string
+	Body []byte
+	Source []byte
+}
+
+func (rev *Revision) Type() string {
+	return "Revision"
+}
+
+// Page as it was saved in this revision
+func (rev *Revision) Page() *Page {
+	return &Page{Title: rev.Title, Name: rev.Name, Format: rev.Format, Body: rev.Body, Source: rev.Source}
+}
+
+// Text compared between revisions: title, slug and format, followed by the body as written by the author
+func (rev *Revision) Text() string {
+	format := rev.Format
+	if format == "" {
+		format = "html"
+	}
+	return "Title: " + rev.Title + "\nSlug: " + rev.Name + "\nFormat: " + format + "\n\n" + rev.Page().SourceString()
+}
+
+// Store current state of page with given key as a new revision
+func savePageRevision(ctx *Context, key string, page *Page) {
+	if key == "" {
+		return
+	}
+	rev := Revision{PageKey: key, Author: ctx.User, Created: time.Now(), Title: page.Title, Name: page.Name, Format: page.Format, Body: page.Body, Source: page.Source}
+	if _, err := ctx.Store.Put(rev.Type(), "", &rev); err != nil {
+		ctx.Session.AddFlash("An error occured while saving the revision: " + err.Error())
+	}
+}
+
+// Remove all revisions of page with given key
+func deletePageRevisions(ctx *Context, key string) {
+	keys, err := ctx.Store.GetAll(NewQuery("Revision").Filter("PageKey =", key), nil)
+	if err != nil {
+		ctx.Session.AddFlash("An error occured while deleting: " + err.Error())
+		return
+	}
+	for _, k := range keys {
+		Delete(ctx, k)
+	}
+}
+
+// Handler: List revisions of a page (GET, comparing two of them if given as from and to) and restore one (POST)
+func RevisionsHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	var page Page
+	key := GetByName(ctx, &page, ctx.Vars["slug"])
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	data := map[string]interface{}{"key": key, "content": &page}
+	switch ctx.Method {
+		case "POST":
+			var rev Revision
+			if GetByKey(ctx, &rev, r.FormValue("Revision")) == "" || rev.PageKey != key {
+				http.NotFound(w, r)
+				return
+			}
+			page.Title, page.Name, page.Format, page.Body, page.Source = rev.Title, rev.Name, rev.Format, rev.Body, rev.Source
+			if _, saved := updateModel(ctx, &page, key); saved {
+				savePageRevision(ctx, key, &page)
+				ctx.Session.AddFlash("Restored revision of " + rev.Created.Format("January 2, 2006 15:04"))
+			}
+			render(w, ctx, []string{"manage","pages","edit"}, data)
+			return
+		case "GET":
+			if r.FormValue("from") != "" && r.FormValue("to") != "" {
+				var from, to Revision
+				if GetByKey(ctx, &from, r.FormValue("from")) == "" || GetByKey(ctx, &to, r.FormValue("to")) == "" || from.PageKey != key || to.PageKey != key {
+					http.NotFound(w, r)
+					return
+				}
+				data["from"], data["to"] = &from, &to
+				data["diff"] = diffLines(strings.Split(from.Text(), "\n"), strings.Split(to.Text(), "\n"))
+			}
+	}
+	var revisions []Revision
+	keys, err := ctx.Store.GetAll(NewQuery("Revision").Filter("PageKey =", key).Order("-Created"), &revisions)
+	if err != nil {
+		ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+	}
+	data["revisions"], data["keys"] = revisions, keys
+	render(w, ctx, []string{"manage","pages","revisions"}, data)
+}
+
+
+/*
+ * Line diff
+ */
+
+// Line of a diff: unchanged (" "), removed ("-") or added ("+")
+type diffLine struct {
+	Op string
+	Text string
+}
+
+// Diff two texts line by line, based on their longest common subsequence
+func diffLines(a, b []string) []diffLine {
+	// Lines the texts start and end with alike need no comparing
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a) - prefix && suffix < len(b) - prefix && a[len(a) - 1 - suffix] == b[len(b) - 1 - suffix] {
+		suffix++
+	}
+	var diff []diffLine
+	for _, line := range a[:prefix] {
+		diff = append(diff, diffLine{" ", line})
+	}
+	diff = diffMiddle(diff, a[prefix:len(a) - suffix], b[prefix:len(b) - suffix])
+	for _, line := range a[len(a) - suffix:] {
+		diff = append(diff, diffLine{" ", line})
+	}
+	return diff
+}
+
+// Append diff of a and b to diff, splitting a in half and b where the common subsequences of the halves meet
+// (Hirschberg's algorithm, taking memory linear in the length of the texts instead of a table of both)
+func diffMiddle(diff []diffLine, a, b []string) []diffLine {
+	switch {
+		case len(a) == 0:
+			for _, line := range b {
+				diff = append(diff, diffLine{"+", line})
+			}
+			return diff
+		case len(b) == 0:
+			for _, line := range a {
+				diff = append(diff, diffLine{"-", line})
+			}
+			return diff
+		case len(a) == 1:
+			for j, line := range b {
+				if line == a[0] {
+					diff = diffMiddle(diff, nil, b[:j])
+					diff = append(diff, diffLine{" ", line})
+					return diffMiddle(diff, nil, b[j + 1:])
+				}
+			}
+			diff = append(diff, diffLine{"-", a[0]})
+			return diffMiddle(diff, nil, b)
+	}
+	mid := len(a) / 2
+	upper := lcsLengths(a[:mid], b, false)
+	lower := lcsLengths(a[mid:], b, true)
+	split, longest := 0, -1
+	for j := 0; j <= len(b); j++ {
+		if upper[j] + lower[j] > longest {
+			split, longest = j, upper[j] + lower[j]
+		}
+	}
+	diff = diffMiddle(diff, a[:mid], b[:split])
+	return diffMiddle(diff, a[mid:], b[split:])
+}
+
+// Lengths of the longest common subsequence of a and b[:j] for every j (or of a and b[j:], comparing from the end), one row at a time
+func lcsLengths(a, b []string, fromEnd bool) []int {
+	at := func(lines []string, i int) string {
+		if fromEnd {
+			return lines[len(lines) - 1 - i]
+		}
+		return lines[i]
+	}
+	prev, row := make([]int, len(b) + 1), make([]int, len(b) + 1)
+	for i := range a {
+		for j := range b {
+			if at(a, i) == at(b, j) {
+				row[j + 1] = prev[j] + 1
+			} else if prev[j + 1] >= row[j] {
+				row[j + 1] = prev[j + 1]
+			} else {
+				row[j + 1] = row[j]
+			}
+		}
+		prev, row = row, prev
+	}
+	if fromEnd {
+		// Index by where the rest of b starts
+		for i, j := 0, len(prev) - 1; i < j; i, j = i + 1, j - 1 {
+			prev[i], prev[j] = prev[j], prev[i]
+		}
+	}
+	return prev
+}
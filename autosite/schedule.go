@@ -0,0 +1,100 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"text/template"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+
+/*
+ * Scheduled publishing of pages
+ */
+
+// Format of datetime-local form fields (server time)
+const formTimeFormat = "2006-01-02T15:04"
+
+// Check whether page is shown to visitors at given time, i.e. published and not waiting for or past its schedule
+func (p *Page) Visible(now time.Time) bool {
+	scheduled := *p
+	scheduled.applySchedule(now)
+	return scheduled.Published && scheduled.PublishAt.IsZero()
+}
+
+// Publish or unpublish page if its scheduled time has come, clearing the schedule. Reports whether anything changed.
+func (p *Page) applySchedule(now time.Time) bool {
+	publish := !p.PublishAt.IsZero() && !now.Before(p.PublishAt)
+	unpublish := !p.UnpublishAt.IsZero() && !now.Before(p.UnpublishAt)
+	// Both due: the later one wins
+	if publish && (!unpublish || p.PublishAt.After(p.UnpublishAt)) {
+		p.Published, p.PublishAt = true, time.Time{}
+		if unpublish {
+			p.UnpublishAt = time.Time{}
+		}
+		return true
+	}
+	if unpublish {
+		p.Published, p.UnpublishAt = false, time.Time{}
+		if publish {
+			p.PublishAt = time.Time{}
+		}
+		return true
+	}
+	return false
+}
+
+// Handler: Flip visibility of pages whose scheduled time has come and put due posts on the timeline (run by cron, like Refresh)
+func PublishScheduled(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method == "GET" {
+		var pages []Page
+		keys, err := ctx.Store.GetAll(NewQuery("Page"), &pages)
+		if err != nil {
+			ctx.Session.AddFlash("An error occured while loading: " + err.Error())
+		}
+		now := time.Now()
+		for i := range pages {
+			if !pages[i].applySchedule(now) {
+				continue
+			}
+			if _, err := ctx.Store.Put("Page", keys[i], &pages[i]); err != nil {
+				ctx.Session.AddFlash("Error saving " + pages[i].Name + ": " + err.Error())
+			} else if pages[i].Published {
+				ctx.Session.AddFlash("Published " + pages[i].Name)
+			} else {
+				ctx.Session.AddFlash("Unpublished " + pages[i].Name)
+			}
+		}
+		announcePosts(ctx)
+	}
+	pageTemplate, _ := template.ParseFiles("templates/manage/refresh.txt")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pageTemplate.Execute(w, map[string]interface{}{"notice": ctx.Session.Flashes()})
+}
+
+// Helper: Return time for datetime-local form field, empty if not set
+func formTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(time.Local).Format(formTimeFormat)
+}
+
+// Helper: Decode datetime-local form field (empty for no time)
+func decodeFormTime(value string) reflect.Value {
+	if value == "" {
+		return reflect.ValueOf(time.Time{})
+	}
+	t, err := time.ParseInLocation(formTimeFormat, value, time.Local)
+	if err != nil {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(t)
+}
@@ -0,0 +1,291 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+
+/*
+ * Envelope encryption of secret model fields (tagged `autosite:"secret"`, with a bool field tagged `autosite:"sealed"` recording whether they are stored encrypted)
+ */
+
+// Master keys (32 bytes each), newest first. The first one encrypts, all of them decrypt. Leave empty to store secrets as plaintext.
+var MasterKeys [][]byte
+
+// Prefix of encrypted values
+const sealedPrefix = "enc:v1:"
+
+var ErrNoMasterKey = errors.New("autosite: a master key is required to decrypt stored secrets")
+
+// Parse master keys given as comma-separated list of base64 encoded keys
+func ParseMasterKeys(config string) ([][]byte, error) {
+	var keys [][]byte
+	for _, k := range strings.Split(config, ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("autosite: master keys need to be base64 encoded and 32 bytes long")
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("autosite: no master keys given")
+	}
+	return keys, nil
+}
+
+// Store wrapper encrypting secret fields on save and decrypting them on load
+type sealedStore struct {
+	Store
+}
+
+// Load entity with given key into dst
+func (s sealedStore) Get(key string, dst interface{}) error {
+	if err := s.Store.Get(key, dst); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(dst).Elem()
+	return openSecrets(v, kindOf(v), key)
+}
+
+// Save src under given key, or under a new key if key is empty
+func (s sealedStore) Put(kind string, key string, src interface{}) (string, error) {
+	v := reflect.ValueOf(src).Elem()
+	if len(secretFields(v.Type())) == 0 {
+		return s.Store.Put(kind, key, src)
+	}
+	// Encrypt a copy, leaving the caller's plaintext alone
+	sealed := reflect.New(v.Type())
+	sealed.Elem().Set(v)
+	if len(MasterKeys) == 0 {
+		if err := setSealed(sealed.Elem(), false); err != nil {
+			return "", err
+		}
+		return s.Store.Put(kind, key, sealed.Interface())
+	}
+	reserved := false
+	if key == "" {
+		// Secrets are bound to their key, so save without them first to get one
+		for _, i := range secretFields(v.Type()) {
+			sealed.Elem().Field(i).SetString("")
+		}
+		if err := setSealed(sealed.Elem(), false); err != nil {
+			return "", err
+		}
+		var err error
+		if key, err = s.Store.Put(kind, "", sealed.Interface()); err != nil {
+			return "", err
+		}
+		sealed.Elem().Set(v)
+		reserved = true
+	}
+	err := sealSecrets(sealed.Elem(), kind, key)
+	if err == nil {
+		key, err = s.Store.Put(kind, key, sealed.Interface())
+	}
+	if err != nil {
+		if reserved {
+			s.Store.Delete(key)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+// Load all matching entities into dst (pointer to slice), or keys only if dst is nil
+func (s sealedStore) GetAll(q *Query, dst interface{}) ([]string, error) {
+	keys, err := s.Store.GetAll(q, dst)
+	if err != nil || dst == nil {
+		return keys, err
+	}
+	slice := reflect.ValueOf(dst).Elem()
+	for i := 0; i < slice.Len() && i < len(keys); i++ {
+		// Slices of pointers (e.g. []*Account) hold their structs one level down
+		elem := reflect.Indirect(slice.Index(i))
+		if !elem.IsValid() {
+			continue
+		}
+		if err := openSecrets(elem, q.Kind, keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Indexes of string fields tagged as secret
+func secretFields(t reflect.Type) []int {
+	var fields []int
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Type.Kind() == reflect.String && f.Tag.Get("autosite") == "secret" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// Record in the field tagged as sealed whether the secrets of struct v are encrypted
+func setSealed(v reflect.Value, sealed bool) error {
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.Type.Kind() == reflect.Bool && f.Tag.Get("autosite") == "sealed" {
+			v.Field(i).SetBool(sealed)
+			return nil
+		}
+	}
+	return errors.New("autosite: " + v.Type().Name() + " has secret fields, but none to record whether they are encrypted")
+}
+
+// Report whether the secrets of struct v are encrypted
+func isSealed(v reflect.Value) bool {
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.Type.Kind() == reflect.Bool && f.Tag.Get("autosite") == "sealed" {
+			return v.Field(i).Bool()
+		}
+	}
+	return false
+}
+
+// Kind of entity v, as passed to Put
+func kindOf(v reflect.Value) string {
+	if m, ok := v.Addr().Interface().(Model); ok {
+		return m.Type()
+	}
+	return v.Type().Name()
+}
+
+// Data an encrypted value is bound to, so it can't be moved to another field or entity
+func secretData(kind string, key string, field string) []byte {
+	return []byte(kind + "\x00" + key + "\x00" + field)
+}
+
+// Encrypt all secret fields of struct v (stored under kind and key) in place
+func sealSecrets(v reflect.Value, kind string, key string) error {
+	for _, i := range secretFields(v.Type()) {
+		f := v.Field(i)
+		if f.String() == "" {
+			continue
+		}
+		sealed, err := seal(MasterKeys[0], []byte(f.String()), secretData(kind, key, v.Type().Field(i).Name))
+		if err != nil {
+			return err
+		}
+		f.SetString(sealed)
+	}
+	return setSealed(v, true)
+}
+
+// Decrypt secret fields of struct v (stored under kind and key) in place, unless stored as plaintext
+func openSecrets(v reflect.Value, kind string, key string) error {
+	if len(secretFields(v.Type())) == 0 || !isSealed(v) {
+		return nil
+	}
+	for _, i := range secretFields(v.Type()) {
+		f := v.Field(i)
+		if f.String() == "" {
+			continue
+		}
+		plain, err := open(f.String(), secretData(kind, key, v.Type().Field(i).Name))
+		if err != nil {
+			return err
+		}
+		f.SetString(string(plain))
+	}
+	return nil
+}
+
+// Keep stored secrets for fields left empty in a submitted form
+func keepSecrets(dst interface{}, stored interface{}) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(stored).Elem()
+	for _, i := range secretFields(d.Type()) {
+		if d.Field(i).String() == "" {
+			d.Field(i).SetString(s.Field(i).String())
+		}
+	}
+}
+
+// Encrypt plaintext with a fresh data key, wrapping the data key with the master key
+func seal(master []byte, plaintext []byte, bound []byte) (string, error) {
+	dataKey := randomKey(32)
+	wrapped, err := gcmSeal(master, dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext, bound)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(append(wrapped, ciphertext...)), nil
+}
+
+// Unwrap data key with any of the master keys and decrypt value
+func open(value string, bound []byte) ([]byte, error) {
+	if len(MasterKeys) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return nil, errors.New("autosite: encrypted value is malformed")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	// Nonce, data key and tag
+	n := 12 + 32 + 16
+	if len(data) < n {
+		return nil, errors.New("autosite: encrypted value is too short")
+	}
+	for _, master := range MasterKeys {
+		dataKey, err := gcmOpen(master, data[:n], nil)
+		if err != nil {
+			continue
+		}
+		return gcmOpen(dataKey, data[n:], bound)
+	}
+	return nil, errors.New("autosite: encrypted value does not match any master key")
+}
+
+// AES-GCM encrypt, prepending the random nonce
+func gcmSeal(key []byte, plaintext []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := randomKey(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plaintext, data), nil
+}
+
+// AES-GCM decrypt value with prepended nonce
+func gcmOpen(key []byte, sealed []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("autosite: encrypted value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], data)
+}
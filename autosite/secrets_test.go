@@ -0,0 +1,64 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"strings"
+	"testing"
+)
+
+
+/*
+ * Envelope encryption against the in-memory backend
+ */
+
+func TestSealedStore(t *testing.T) {
+	defer func(keys [][]byte) { MasterKeys = keys }(MasterKeys)
+	MasterKeys = [][]byte{randomKey(32)}
+	raw := NewMemoryStore()
+	store := sealedStore{raw}
+	// Typed secrets are encrypted whatever they look like
+	account := Account{Name: "github", Token: sealedPrefix + "typed-by-hand", Secret: "s3cret"}
+	key, err := store.Put("Account", "", &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Account
+	if err := raw.Get(key, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Sealed || stored.Token == account.Token || !strings.HasPrefix(stored.Secret, sealedPrefix) {
+		t.Errorf("stored %+v", stored)
+	}
+	var loaded []Account
+	if _, err := store.GetAll(NewQuery("Account"), &loaded); err != nil || len(loaded) != 1 || loaded[0].Token != account.Token || loaded[0].Secret != "s3cret" {
+		t.Errorf("got %+v, error %v", loaded, err)
+	}
+	
+	// Encrypted values don't open under another key or field
+	copied, _ := raw.Put("Account", "", &stored)
+	var moved Account
+	if err := store.Get(copied, &moved); err == nil {
+		t.Error("opened secrets copied to another entity")
+	}
+	stored.Token, stored.Secret = stored.Secret, stored.Token
+	raw.Put("Account", key, &stored)
+	if err := store.Get(key, &moved); err == nil {
+		t.Error("opened secrets swapped between fields")
+	}
+	
+	// Without master keys, secrets are stored and read as plaintext, whatever they look like
+	MasterKeys = nil
+	if _, err := store.Put("Account", key, &account); err != nil {
+		t.Fatal(err)
+	}
+	var plain Account
+	if err := store.Get(key, &plain); err != nil || plain.Sealed || plain.Token != account.Token {
+		t.Errorf("got %+v, error %v", plain, err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/gorilla/sessions"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+/*
+ * Session cookie keys (from configuration, or generated and kept in the store)
+ */
+
+// Name of the session cookie
+const sessionName = "autosite-go-session"
+
+// Hash/encryption key pairs, newest first. Leave empty to have keys generated and kept in the store.
+var SessionKeys [][]byte
+
+// Only send session cookies over HTTPS
+var SecureCookies bool
+
+// How long keys loaded from the store are cached, so rotations reach all instances
+const sessionKeysTTL = time.Minute
+
+// Number of stored key pairs kept around for verifying older cookies
+const sessionKeysKept = 2
+
+var cookieStore struct {
+	sync.Mutex
+	store *sessions.CookieStore
+	loaded time.Time
+}
+
+// Parse key pairs given as comma-separated list of base64 "hashkey:encryptionkey" pairs
+func ParseSessionKeys(config string) ([][]byte, error) {
+	var keys [][]byte
+	for _, pair := range strings.Split(config, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		hashKey, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil || len(hashKey) < 32 {
+			return nil, errors.New("autosite: session hash keys need to be base64 encoded and at least 32 bytes long")
+		}
+		var encryptionKey []byte
+		if len(parts) > 1 {
+			encryptionKey, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil || (len(encryptionKey) != 16 && len(encryptionKey) != 24 && len(encryptionKey) != 32) {
+				return nil, errors.New("autosite: session encryption keys need to be base64 encoded and 16, 24 or 32 bytes long")
+			}
+		}
+		keys = append(keys, hashKey, encryptionKey)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("autosite: no session keys given")
+	}
+	return keys, nil
+}
+
+// Return cookie store for the current key pairs
+func sessionStore(s Store) *sessions.CookieStore {
+	cookieStore.Lock()
+	defer cookieStore.Unlock()
+	if cookieStore.store != nil && (len(SessionKeys) > 0 || time.Since(cookieStore.loaded) < sessionKeysTTL) {
+		return cookieStore.store
+	}
+	keys := SessionKeys
+	if len(keys) == 0 {
+		var err error
+		if keys, err = storedSessionKeys(s); err != nil {
+			log.Printf("Error loading session keys: %s", err.Error())
+			if cookieStore.store != nil {
+				return cookieStore.store
+			}
+			keys = [][]byte{randomKey(64), randomKey(32)}
+		}
+	}
+	cookieStore.store = sessions.NewCookieStore(keys...)
+	cookieStore.store.Options = &sessions.Options{
+		Path: "/",
+		MaxAge: 86400 * 30,
+		Secure: SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	cookieStore.loaded = time.Now()
+	return cookieStore.store
+}
+
+// Load key pairs from the store, generating the first pair if there is none yet
+func storedSessionKeys(s Store) ([][]byte, error) {
+	var stored []SessionKey
+	if _, err := s.GetAll(NewQuery("SessionKey").Order("-Created"), &stored); err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		key := newSessionKey()
+		if _, err := s.Put("SessionKey", "", &key); err != nil {
+			return nil, err
+		}
+		stored = append(stored, key)
+	}
+	var keys [][]byte
+	for _, key := range stored {
+		keys = append(keys, key.HashKey, key.EncryptionKey)
+	}
+	return keys, nil
+}
+
+// Add new stored key pair for signing and drop the ones no longer needed for verifying
+func RotateSessionKeys(s Store) error {
+	if len(SessionKeys) > 0 {
+		return errors.New("Session keys are set in the configuration, rotate them there")
+	}
+	key := newSessionKey()
+	if _, err := s.Put("SessionKey", "", &key); err != nil {
+		return err
+	}
+	keys, err := s.GetAll(NewQuery("SessionKey").Order("-Created").Offset(sessionKeysKept), nil)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.Delete(k); err != nil {
+			return err
+		}
+	}
+	cookieStore.Lock()
+	cookieStore.store = nil
+	cookieStore.Unlock()
+	return nil
+}
+
+func newSessionKey() SessionKey {
+	return SessionKey{HashKey: randomKey(64), EncryptionKey: randomKey(32), Created: time.Now()}
+}
+
+// Return n random bytes
+func randomKey(n int) []byte {
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Handler: Rotate stored session keys
+func SessionKeysHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method == "POST" {
+		if err := RotateSessionKeys(ctx.Store); err != nil {
+			ctx.Session.AddFlash("An error occured while rotating session keys: " + err.Error())
+		} else {
+			// Re-sign own session with the new key
+			if session, err := sessionStore(ctx.Store).New(r, sessionName); err == nil {
+				session.Values = ctx.Session.Values
+				ctx.Session = session
+			}
+			ctx.Session.AddFlash("Session keys have been rotated, older sessions stay valid until the next rotation")
+		}
+	}
+	ctx.Session.Save(r, w)
+	http.Redirect(w, r, "/manage/users", 302)
+}
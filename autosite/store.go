@@ -0,0 +1,230 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+
+/*
+ * Storage interface shared by all backends
+ */
+
+// Store persists models of any kind. Keys are opaque strings handed out by the backend.
+type Store interface {
+	// Load entity with given key into dst
+	Get(key string, dst interface{}) error
+	// Save src under given key, or under a new key if key is empty
+	Put(kind string, key string, src interface{}) (string, error)
+	// Return key for the entity of given kind identified by name (saving it twice overwrites it)
+	NamedKey(kind string, name string) string
+	// Remove entity with given key
+	Delete(key string) error
+	// Load all matching entities into dst (pointer to slice), or keys only if dst is nil
+	GetAll(q *Query, dst interface{}) ([]string, error)
+	// Count matching entities
+	Count(q *Query) (int, error)
+}
+
+// Returned when a key or query does not match any entity
+var ErrNoSuchEntity = errors.New("autosite: no such entity")
+
+// Storage backend factory, called once per request (see NewMemoryStore for tests)
+var Storage func(r *http.Request) Store
+
+// All kinds known to the application, for backends that need a schema up front
+var models = []Model{&Site{}, &Page{}, &Account{}, &Status{}, &Archive{}, &User{}, &SessionKey{}, &Revision{}, &Post{}}
+
+// Return a fresh instance of given kind
+func newModel(kind string) Model {
+	for _, m := range models {
+		if m.Type() == kind {
+			return reflect.New(reflect.TypeOf(m).Elem()).Interface().(Model)
+		}
+	}
+	return nil
+}
+
+
+/*
+ * Backend-independent query description
+ */
+
+type Filter struct {
+	Field string
+	Op string
+	Value interface{}
+}
+
+type Query struct {
+	Kind string
+	Filters []Filter
+	Orders []string
+	Skip int
+	Max int
+}
+
+// Start new query for given kind
+func NewQuery(kind string) *Query {
+	return &Query{Kind: kind}
+}
+
+// Add filter in the form of "Field op" (op being one of =, <, <=, >, >=)
+func (q *Query) Filter(filter string, value interface{}) *Query {
+	parts := strings.Fields(filter)
+	f := Filter{Field: parts[0], Op: "=", Value: value}
+	if len(parts) > 1 {
+		f.Op = parts[1]
+	}
+	q.Filters = append(q.Filters, f)
+	return q
+}
+
+// Add sort order, prefix field with "-" for descending order
+func (q *Query) Order(field string) *Query {
+	q.Orders = append(q.Orders, field)
+	return q
+}
+
+// Limit number of results
+func (q *Query) Limit(n int) *Query {
+	q.Max = n
+	return q
+}
+
+// Skip first n results
+func (q *Query) Offset(n int) *Query {
+	q.Skip = n
+	return q
+}
+
+// Check whether struct value v passes all filters
+func (q *Query) matches(v reflect.Value) bool {
+	for _, f := range q.Filters {
+		field := v.FieldByName(f.Field)
+		if !field.IsValid() {
+			return false
+		}
+		c, err := compare(field, reflect.ValueOf(f.Value))
+		if err != nil {
+			return false
+		}
+		switch f.Op {
+			case "=":
+				if c != 0 { return false }
+			case "<":
+				if c >= 0 { return false }
+			case "<=":
+				if c > 0 { return false }
+			case ">":
+				if c <= 0 { return false }
+			case ">=":
+				if c < 0 { return false }
+			default:
+				return false
+		}
+	}
+	return true
+}
+
+// Report whether struct value a sorts before b according to query order
+func (q *Query) less(a, b reflect.Value) bool {
+	for _, o := range q.Orders {
+		field := strings.TrimPrefix(o, "-")
+		c, _ := compare(a.FieldByName(field), b.FieldByName(field))
+		if c == 0 {
+			continue
+		}
+		if strings.HasPrefix(o, "-") {
+			return c > 0
+		}
+		return c < 0
+	}
+	return false
+}
+
+// Apply offset and limit to n results, returning the range to keep
+func (q *Query) window(n int) (int, int) {
+	start, end := q.Skip, n
+	if start > n {
+		start = n
+	}
+	if q.Max > 0 && start + q.Max < end {
+		end = start + q.Max
+	}
+	return start, end
+}
+
+// Compare two basic values (strings, numbers, bools and times)
+func compare(a, b reflect.Value) (int, error) {
+	if !a.IsValid() || !b.IsValid() {
+		return 0, errors.New("autosite: cannot compare missing value")
+	}
+	if ta, ok := a.Interface().(time.Time); ok {
+		tb, ok := b.Interface().(time.Time)
+		if !ok {
+			return 0, fmt.Errorf("autosite: cannot compare time with %s", b.Type())
+		}
+		switch {
+			case ta.Before(tb):
+				return -1, nil
+			case ta.After(tb):
+				return 1, nil
+		}
+		return 0, nil
+	}
+	switch a.Kind() {
+		case reflect.String:
+			if b.Kind() == reflect.String {
+				return strings.Compare(a.String(), b.String()), nil
+			}
+		case reflect.Bool:
+			if b.Kind() == reflect.Bool {
+				switch {
+					case a.Bool() == b.Bool():
+						return 0, nil
+					case b.Bool():
+						return -1, nil
+				}
+				return 1, nil
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			switch b.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					return compareInt(a.Int(), b.Int()), nil
+			}
+		case reflect.Float32, reflect.Float64:
+			switch b.Kind() {
+				case reflect.Float32, reflect.Float64:
+					switch {
+						case a.Float() < b.Float():
+							return -1, nil
+						case a.Float() > b.Float():
+							return 1, nil
+					}
+					return 0, nil
+			}
+	}
+	return 0, fmt.Errorf("autosite: cannot compare %s with %s", a.Type(), b.Type())
+}
+
+func compareInt(a, b int64) int {
+	switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+//go:build appengine
+// +build appengine
+
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"reflect"
+)
+
+
+/*
+ * App Engine datastore backend
+ */
+
+type DatastoreStore struct {
+	c appengine.Context
+}
+
+// Create datastore backend for the given App Engine context
+func NewDatastoreStore(c appengine.Context) *DatastoreStore {
+	return &DatastoreStore{c: c}
+}
+
+// Load entity with given key into dst
+func (s *DatastoreStore) Get(key string, dst interface{}) error {
+	k, err := datastore.DecodeKey(key)
+	if err != nil {
+		return err
+	}
+	if site, ok := dst.(*Site); ok {
+		dst = datastoreSite{site}
+	}
+	err = datastore.Get(s.c, k, dst)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchEntity
+	}
+	return err
+}
+
+// Save src under given key, or under a new key if key is empty
+func (s *DatastoreStore) Put(kind string, key string, src interface{}) (string, error) {
+	k := datastore.NewIncompleteKey(s.c, kind, nil)
+	if key != "" {
+		var err error
+		if k, err = datastore.DecodeKey(key); err != nil {
+			return "", err
+		}
+	}
+	if site, ok := src.(*Site); ok {
+		src = datastoreSite{site}
+	}
+	k, err := datastore.Put(s.c, k, src)
+	if err != nil {
+		return "", err
+	}
+	return k.Encode(), nil
+}
+
+// Return key for the entity of given kind identified by name
+func (s *DatastoreStore) NamedKey(kind string, name string) string {
+	return datastore.NewKey(s.c, kind, name, 0, nil).Encode()
+}
+
+// Remove entity with given key
+func (s *DatastoreStore) Delete(key string) error {
+	k, err := datastore.DecodeKey(key)
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(s.c, k)
+}
+
+// Load all matching entities into dst (pointer to slice), or keys only if dst is nil
+func (s *DatastoreStore) GetAll(q *Query, dst interface{}) ([]string, error) {
+	dq := s.query(q)
+	if dst == nil {
+		dq = dq.KeysOnly()
+	}
+	var keys []*datastore.Key
+	var err error
+	if q.Kind == "Site" && dst != nil {
+		keys, err = s.getAllSites(dq, dst)
+	} else {
+		keys, err = dq.GetAll(s.c, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]string, len(keys))
+	for i, k := range keys {
+		encoded[i] = k.Encode()
+	}
+	return encoded, nil
+}
+
+// Count matching entities
+func (s *DatastoreStore) Count(q *Query) (int, error) {
+	return s.query(q).Count(s.c)
+}
+
+// Translate backend-independent query into datastore query
+func (s *DatastoreStore) query(q *Query) *datastore.Query {
+	dq := datastore.NewQuery(q.Kind)
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Field + " " + f.Op, f.Value)
+	}
+	for _, o := range q.Orders {
+		dq = dq.Order(o)
+	}
+	if q.Skip > 0 {
+		dq = dq.Offset(q.Skip)
+	}
+	if q.Max > 0 {
+		dq = dq.Limit(q.Max)
+	}
+	return dq
+}
+
+
+/*
+ * Site entities, which hold the template as a datastore key (as stored before there were other backends)
+ */
+
+type datastoreSite struct {
+	*Site
+}
+
+// Load properties, encoding the template key
+func (e datastoreSite) Load(c <-chan datastore.Property) error {
+	props := make(chan datastore.Property)
+	done := make(chan error, 1)
+	go func() {
+		done <- datastore.LoadStruct(e.Site, props)
+	}()
+	var templateKey *datastore.Key
+	for p := range c {
+		if k, ok := p.Value.(*datastore.Key); ok && p.Name == "TemplateKey" {
+			templateKey = k
+			continue
+		}
+		props <- p
+	}
+	close(props)
+	if err := <-done; err != nil {
+		return err
+	}
+	if templateKey != nil {
+		e.TemplateKey = templateKey.Encode()
+	}
+	return nil
+}
+
+// Save properties, decoding the template key
+func (e datastoreSite) Save(c chan<- datastore.Property) error {
+	props := make(chan datastore.Property)
+	done := make(chan error, 1)
+	go func() {
+		done <- datastore.SaveStruct(e.Site, props)
+	}()
+	for p := range props {
+		if p.Name == "TemplateKey" {
+			var k *datastore.Key
+			if e.TemplateKey != "" {
+				k, _ = datastore.DecodeKey(e.TemplateKey)
+			}
+			p.Value = k
+		}
+		c <- p
+	}
+	close(c)
+	return <-done
+}
+
+// Load all Site entities of query into dst (pointer to slice of Site or *Site)
+func (s *DatastoreStore) getAllSites(dq *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	slice := reflect.ValueOf(dst).Elem()
+	var keys []*datastore.Key
+	for t := dq.Run(s.c); ; {
+		site := new(Site)
+		k, err := t.Next(datastoreSite{site})
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+		if slice.Type().Elem().Kind() == reflect.Ptr {
+			slice.Set(reflect.Append(slice, reflect.ValueOf(site)))
+		} else {
+			slice.Set(reflect.Append(slice, reflect.ValueOf(site).Elem()))
+		}
+	}
+	return keys, nil
+}
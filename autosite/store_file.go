@@ -0,0 +1,97 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+
+/*
+ * File-backed storage backend (in-memory store written to a JSON file on every change)
+ */
+
+type FileStore struct {
+	*MemoryStore
+	path string
+	write sync.Mutex
+}
+
+// On-disk format
+type fileSnapshot struct {
+	Next int64
+	Entities map[string]json.RawMessage
+}
+
+// Open file store at path, creating the file on first write
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot fileSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Entities != nil {
+		s.entities = snapshot.Entities
+	}
+	s.next = snapshot.Next
+	return s, nil
+}
+
+// Save src under given key, or under a new key if key is empty
+func (s *FileStore) Put(kind string, key string, src interface{}) (string, error) {
+	key, err := s.MemoryStore.Put(kind, key, src)
+	if err != nil {
+		return "", err
+	}
+	return key, s.flush()
+}
+
+// Remove entity with given key
+func (s *FileStore) Delete(key string) error {
+	if err := s.MemoryStore.Delete(key); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// Write current state to disk, replacing the old file atomically
+func (s *FileStore) flush() error {
+	s.write.Lock()
+	defer s.write.Unlock()
+	s.mu.RLock()
+	data, err := json.Marshal(fileSnapshot{Next: s.next, Entities: s.entities})
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path) + ".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,162 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+
+/*
+ * In-memory storage backend (tests, development and as base for other backends)
+ */
+
+type MemoryStore struct {
+	mu sync.RWMutex
+	entities map[string]json.RawMessage
+	next int64
+}
+
+// Create empty in-memory store, safe for concurrent use
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entities: make(map[string]json.RawMessage)}
+}
+
+// Load entity with given key into dst
+func (s *MemoryStore) Get(key string, dst interface{}) error {
+	s.mu.RLock()
+	data, ok := s.entities[key]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// Save src under given key, or under a new key if key is empty
+func (s *MemoryStore) Put(kind string, key string, src interface{}) (string, error) {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "" {
+		s.next++
+		key = kind + "/" + strconv.FormatInt(s.next, 10)
+	}
+	if keyKind(key) != kind {
+		return "", fmt.Errorf("autosite: key %q does not belong to kind %s", key, kind)
+	}
+	s.entities[key] = data
+	return key, nil
+}
+
+// Return key for the entity of given kind identified by name (marked to never clash with numbered keys)
+func (s *MemoryStore) NamedKey(kind string, name string) string {
+	return kind + "/@" + name
+}
+
+// Remove entity with given key
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entities[key]; !ok {
+		return ErrNoSuchEntity
+	}
+	delete(s.entities, key)
+	return nil
+}
+
+// Load all matching entities into dst (pointer to slice), or keys only if dst is nil
+func (s *MemoryStore) GetAll(q *Query, dst interface{}) ([]string, error) {
+	keys, values, err := s.run(q)
+	if err != nil || dst == nil {
+		return keys, err
+	}
+	slice := reflect.ValueOf(dst)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("autosite: GetAll expects pointer to slice, got %T", dst)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	for _, v := range values {
+		elem := reflect.New(v.Type())
+		elem.Elem().Set(v)
+		if elemType.Kind() == reflect.Ptr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+	return keys, nil
+}
+
+// Count matching entities
+func (s *MemoryStore) Count(q *Query) (int, error) {
+	keys, _, err := s.run(q)
+	return len(keys), err
+}
+
+// Decode, filter, sort and window all entities of the query's kind
+func (s *MemoryStore) run(q *Query) ([]string, []reflect.Value, error) {
+	if newModel(q.Kind) == nil {
+		return nil, nil, fmt.Errorf("autosite: unknown kind %s", q.Kind)
+	}
+	type entity struct {
+		key string
+		value reflect.Value
+	}
+	var found []entity
+	s.mu.RLock()
+	for key, data := range s.entities {
+		if keyKind(key) != q.Kind {
+			continue
+		}
+		m := newModel(q.Kind)
+		if err := json.Unmarshal(data, m); err != nil {
+			s.mu.RUnlock()
+			return nil, nil, err
+		}
+		if v := reflect.ValueOf(m).Elem(); q.matches(v) {
+			found = append(found, entity{key, v})
+		}
+	}
+	s.mu.RUnlock()
+	sort.SliceStable(found, func(i, j int) bool {
+		if q.less(found[i].value, found[j].value) {
+			return true
+		}
+		if q.less(found[j].value, found[i].value) {
+			return false
+		}
+		return found[i].key < found[j].key
+	})
+	start, end := q.window(len(found))
+	keys := make([]string, 0, end - start)
+	values := make([]reflect.Value, 0, end - start)
+	for _, e := range found[start:end] {
+		keys = append(keys, e.key)
+		values = append(values, e.value)
+	}
+	return keys, values, nil
+}
+
+// Return kind encoded in a memory store key
+func keyKind(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
@@ -0,0 +1,566 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+/*
+ * SQLite storage backend (one table per kind, driver registered by the caller)
+ */
+
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Versioned schema, applied in order on startup. Only ever append to this list.
+var sqliteMigrations = []string{
+	// 1: Initial tables, including the indexes from index.yaml
+	`CREATE TABLE Site (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		SiteTitle TEXT NOT NULL DEFAULT '',
+		HomepageTitle TEXT NOT NULL DEFAULT '',
+		Footer TEXT NOT NULL DEFAULT '',
+		TrackerCode BLOB,
+		TemplateKey TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE Page (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Position INTEGER NOT NULL DEFAULT 0,
+		Title TEXT NOT NULL DEFAULT '',
+		Body BLOB,
+		Name TEXT NOT NULL DEFAULT '',
+		Published INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX Page_Published_Position ON Page (Published, Position);
+	CREATE TABLE Account (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL DEFAULT '',
+		ConsumerKey TEXT NOT NULL DEFAULT '',
+		ConsumerSecret TEXT NOT NULL DEFAULT '',
+		Token TEXT NOT NULL DEFAULT '',
+		Secret TEXT NOT NULL DEFAULT '',
+		RequestUrl TEXT NOT NULL DEFAULT '',
+		AuthUrl TEXT NOT NULL DEFAULT '',
+		AccessUrl TEXT NOT NULL DEFAULT '',
+		Repost INTEGER NOT NULL DEFAULT 0,
+		Expires TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE Status (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL DEFAULT '',
+		OriginalId INTEGER NOT NULL DEFAULT 0,
+		Heading TEXT NOT NULL DEFAULT '',
+		Content TEXT NOT NULL DEFAULT '',
+		Link TEXT NOT NULL DEFAULT '',
+		Created TEXT NOT NULL DEFAULT '',
+		User TEXT NOT NULL DEFAULT '',
+		UserUrl TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX Status_Name_Created ON Status (Name, Created DESC);`,
+	// 2: Admin users
+	`CREATE TABLE User (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL DEFAULT '',
+		PasswordHash BLOB,
+		Created TEXT NOT NULL DEFAULT ''
+	);
+	CREATE UNIQUE INDEX User_Name ON User (Name);`,
+	// 3: Generated session keys
+	`CREATE TABLE SessionKey (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		HashKey BLOB,
+		EncryptionKey BLOB,
+		Created TEXT NOT NULL DEFAULT ''
+	);`,
+	// 4: OAuth2 refresh tokens
+	`ALTER TABLE Account ADD COLUMN RefreshToken TEXT NOT NULL DEFAULT '';`,
+	// 5: PKCE setting
+	`ALTER TABLE Account ADD COLUMN PKCE INTEGER NOT NULL DEFAULT 0;`,
+	// 6: Feed URLs and entry GUIDs
+	`ALTER TABLE Account ADD COLUMN BaseUrl TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Status ADD COLUMN Guid TEXT NOT NULL DEFAULT '';`,
+	// 7: Repost target
+	`ALTER TABLE Account ADD COLUMN RepostTo TEXT NOT NULL DEFAULT '';`,
+	// 8: Webhook secret
+	`ALTER TABLE Account ADD COLUMN WebhookSecret TEXT NOT NULL DEFAULT '';`,
+	// 9: Named keys (NULL for numbered rows)
+	`ALTER TABLE Site ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX Site_key_name ON Site (key_name);
+	ALTER TABLE Page ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX Page_key_name ON Page (key_name);
+	ALTER TABLE Account ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX Account_key_name ON Account (key_name);
+	ALTER TABLE Status ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX Status_key_name ON Status (key_name);
+	ALTER TABLE User ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX User_key_name ON User (key_name);
+	ALTER TABLE SessionKey ADD COLUMN key_name TEXT;
+	CREATE UNIQUE INDEX SessionKey_key_name ON SessionKey (key_name);`,
+	// 10: Retention settings and archived updates
+	`ALTER TABLE Account ADD COLUMN Retention TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Account ADD COLUMN RetentionLimit INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE Account ADD COLUMN KeepArchive INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE Archive (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL DEFAULT '',
+		OriginalId INTEGER NOT NULL DEFAULT 0,
+		Guid TEXT NOT NULL DEFAULT '',
+		Heading TEXT NOT NULL DEFAULT '',
+		Content TEXT NOT NULL DEFAULT '',
+		Link TEXT NOT NULL DEFAULT '',
+		Created TEXT NOT NULL DEFAULT '',
+		User TEXT NOT NULL DEFAULT '',
+		UserUrl TEXT NOT NULL DEFAULT '',
+		key_name TEXT
+	);
+	CREATE UNIQUE INDEX Archive_key_name ON Archive (key_name);
+	CREATE INDEX Archive_Created ON Archive (Created DESC);`,
+	// 11: Markdown pages
+	`ALTER TABLE Page ADD COLUMN Format TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Page ADD COLUMN Source BLOB;`,
+	// 12: Page revisions
+	`CREATE TABLE Revision (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		PageKey TEXT NOT NULL DEFAULT '',
+		Author TEXT NOT NULL DEFAULT '',
+		Created TEXT NOT NULL DEFAULT '',
+		Title TEXT NOT NULL DEFAULT '',
+		Name TEXT NOT NULL DEFAULT '',
+		Format TEXT NOT NULL DEFAULT '',
+		Body BLOB,
+		Source BLOB,
+		key_name TEXT
+	);
+	CREATE UNIQUE INDEX Revision_key_name ON Revision (key_name);
+	CREATE INDEX Revision_PageKey_Created ON Revision (PageKey, Created DESC);`,
+	// 13: Scheduled publishing
+	`ALTER TABLE Page ADD COLUMN PublishAt TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Page ADD COLUMN UnpublishAt TEXT NOT NULL DEFAULT '';`,
+	// 14: Blog posts
+	`CREATE TABLE Post (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Title TEXT NOT NULL DEFAULT '',
+		Name TEXT NOT NULL DEFAULT '',
+		Format TEXT NOT NULL DEFAULT '',
+		Body BLOB,
+		Source BLOB,
+		Tags TEXT NOT NULL DEFAULT '',
+		Date TEXT NOT NULL DEFAULT '',
+		Draft INTEGER NOT NULL DEFAULT 0,
+		Author TEXT NOT NULL DEFAULT '',
+		Timeline INTEGER NOT NULL DEFAULT 0,
+		key_name TEXT
+	);
+	CREATE UNIQUE INDEX Post_key_name ON Post (key_name);
+	CREATE INDEX Post_Name ON Post (Name);
+	CREATE INDEX Post_Draft_Date ON Post (Draft, Date DESC);`,
+	// 15: Newest update fetched per account
+	`ALTER TABLE Account ADD COLUMN LatestId INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE Account ADD COLUMN LatestGuid TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Account ADD COLUMN LatestCreated TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Account ADD COLUMN LatestUser TEXT NOT NULL DEFAULT '';`,
+	// 16: Whether account secrets are stored encrypted
+	`ALTER TABLE Account ADD COLUMN Sealed INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Sortable text representation of times
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Create SQLite backend on an open database, migrating the schema to the latest version
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	// One connection, so refreshes in the background and requests take turns writing instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	s := &SQLiteStore{db: db}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Apply all migrations newer than the current schema version
+func (s *SQLiteStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("autosite: schema migration %d failed: %s", i + 1, err.Error())
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, i + 1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load entity with given key into dst
+func (s *SQLiteStore) Get(key string, dst interface{}) error {
+	kind, column, id, err := sqliteKey(key)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(dst).Elem()
+	fields := sqliteFields(v.Type())
+	row := s.db.QueryRow(`SELECT ` + sqliteColumns(fields) + ` FROM ` + kind + ` WHERE ` + column + ` = ?`, id)
+	targets := sqliteTargets(fields)
+	if err := row.Scan(targets...); err == sql.ErrNoRows {
+		return ErrNoSuchEntity
+	} else if err != nil {
+		return err
+	}
+	return sqliteAssign(v, fields, targets)
+}
+
+// Save src under given key, or under a new key if key is empty
+func (s *SQLiteStore) Put(kind string, key string, src interface{}) (string, error) {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	fields := sqliteFields(v.Type())
+	values, err := sqliteValues(v, fields)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(fields)), ", ")
+		res, err := s.db.Exec(`INSERT INTO ` + kind + ` (` + sqliteColumns(fields) + `) VALUES (` + marks + `)`, values...)
+		if err != nil {
+			return "", err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return "", err
+		}
+		return kind + "/" + strconv.FormatInt(id, 10), nil
+	}
+	keyKind, column, id, err := sqliteKey(key)
+	if err != nil {
+		return "", err
+	}
+	if keyKind != kind {
+		return "", fmt.Errorf("autosite: key %q does not belong to kind %s", key, kind)
+	}
+	columns := append([]string{column}, fields...)
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := `INSERT OR REPLACE INTO ` + kind + ` (` + sqliteColumns(columns) + `) VALUES (` + marks + `)`
+	if column == "key_name" {
+		// Update in place, so the row keeps its id
+		updates := make([]string, len(fields))
+		for i, f := range fields {
+			updates[i] = `"` + f + `" = excluded."` + f + `"`
+		}
+		query = `INSERT INTO ` + kind + ` (` + sqliteColumns(columns) + `) VALUES (` + marks + `) ON CONFLICT (key_name) DO UPDATE SET ` + strings.Join(updates, ", ")
+	}
+	_, err = s.db.Exec(query, append([]interface{}{id}, values...)...)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Return key for the entity of given kind identified by name
+func (s *SQLiteStore) NamedKey(kind string, name string) string {
+	return kind + "/@" + name
+}
+
+// Remove entity with given key
+func (s *SQLiteStore) Delete(key string) error {
+	kind, column, id, err := sqliteKey(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`DELETE FROM ` + kind + ` WHERE ` + column + ` = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchEntity
+	}
+	return nil
+}
+
+// Load all matching entities into dst (pointer to slice), or keys only if dst is nil
+func (s *SQLiteStore) GetAll(q *Query, dst interface{}) ([]string, error) {
+	m := newModel(q.Kind)
+	if m == nil {
+		return nil, fmt.Errorf("autosite: unknown kind %s", q.Kind)
+	}
+	fields := sqliteFields(reflect.TypeOf(m).Elem())
+	columns := []string{"id", "key_name"}
+	if dst != nil {
+		columns = append(columns, fields...)
+	}
+	where, args, err := sqliteWhere(q)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT ` + sqliteColumns(columns) + ` FROM ` + q.Kind + where + sqliteOrder(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slice, sample reflect.Value
+	if dst != nil {
+		slice = reflect.ValueOf(dst).Elem()
+		sample = reflect.New(slice.Type().Elem()).Elem()
+	}
+	var keys []string
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		targets := []interface{}{&id, &name}
+		if dst != nil {
+			targets = append(targets, sqliteTargets(fields)...)
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		if name.Valid {
+			keys = append(keys, s.NamedKey(q.Kind, name.String))
+		} else {
+			keys = append(keys, q.Kind + "/" + strconv.FormatInt(id, 10))
+		}
+		if dst == nil {
+			continue
+		}
+		elem := reflect.New(reflect.TypeOf(m).Elem())
+		if err := sqliteAssign(elem.Elem(), fields, targets[2:]); err != nil {
+			return nil, err
+		}
+		if sample.Kind() == reflect.Ptr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+	return keys, rows.Err()
+}
+
+// Count matching entities
+func (s *SQLiteStore) Count(q *Query) (int, error) {
+	where, args, err := sqliteWhere(q)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM (SELECT id FROM ` + q.Kind + where + sqliteOrder(q) + `)`, args...).Scan(&n)
+	return n, err
+}
+
+// Split key into kind and the column and value identifying the row (row id or key name)
+func sqliteKey(key string) (string, string, interface{}, error) {
+	kind := keyKind(key)
+	if kind == "" || newModel(kind) == nil {
+		return "", "", nil, fmt.Errorf("autosite: invalid key %q", key)
+	}
+	rest := strings.TrimPrefix(key, kind + "/")
+	if strings.HasPrefix(rest, "@") && len(rest) > 1 {
+		return kind, "key_name", rest[1:], nil
+	}
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("autosite: invalid key %q", key)
+	}
+	return kind, "id", id, nil
+}
+
+// Return exported field names of struct type t, which double as column names
+func sqliteFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" && !f.Anonymous {
+			fields = append(fields, f.Name)
+		}
+	}
+	return fields
+}
+
+// Quote and join column names
+func sqliteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = `"` + c + `"`
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Build WHERE clause from query filters
+func sqliteWhere(q *Query) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	for _, f := range q.Filters {
+		switch f.Op {
+			case "=", "<", "<=", ">", ">=":
+			default:
+				return "", nil, fmt.Errorf("autosite: unsupported filter operator %q", f.Op)
+		}
+		value, err := sqliteValue(reflect.ValueOf(f.Value))
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, `"` + f.Field + `" ` + f.Op + ` ?`)
+		args = append(args, value)
+	}
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return ` WHERE ` + strings.Join(conditions, " AND "), args, nil
+}
+
+// Build ORDER BY, LIMIT and OFFSET clauses from query
+func sqliteOrder(q *Query) string {
+	var orders []string
+	for _, o := range q.Orders {
+		if strings.HasPrefix(o, "-") {
+			orders = append(orders, `"` + o[1:] + `" DESC`)
+		} else {
+			orders = append(orders, `"` + o + `"`)
+		}
+	}
+	clause := ` ORDER BY ` + strings.Join(append(orders, "id"), ", ")
+	if q.Max > 0 || q.Skip > 0 {
+		limit := -1
+		if q.Max > 0 {
+			limit = q.Max
+		}
+		clause += ` LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(q.Skip)
+	}
+	return clause
+}
+
+// Convert struct fields to column values
+func sqliteValues(v reflect.Value, fields []string) ([]interface{}, error) {
+	values := make([]interface{}, len(fields))
+	for i, f := range fields {
+		value, err := sqliteValue(v.FieldByName(f))
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Convert single value to its column representation
+func sqliteValue(v reflect.Value) (interface{}, error) {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(sqliteTimeFormat), nil
+	}
+	switch v.Kind() {
+		case reflect.String:
+			return v.String(), nil
+		case reflect.Bool:
+			return v.Bool(), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return v.Int(), nil
+		case reflect.Float32, reflect.Float64:
+			return v.Float(), nil
+		case reflect.Slice:
+			if v.Type().Elem().Kind() == reflect.Uint8 {
+				return v.Bytes(), nil
+			}
+	}
+	data, err := json.Marshal(v.Interface())
+	return string(data), err
+}
+
+// Scan targets for struct fields
+func sqliteTargets(fields []string) []interface{} {
+	targets := make([]interface{}, len(fields))
+	for i := range fields {
+		targets[i] = new(interface{})
+	}
+	return targets
+}
+
+// Copy scanned column values into struct fields
+func sqliteAssign(v reflect.Value, fields []string, targets []interface{}) error {
+	for i, f := range fields {
+		field := v.FieldByName(f)
+		raw := *(targets[i].(*interface{}))
+		if raw == nil {
+			continue
+		}
+		if b, ok := raw.([]byte); ok && field.Kind() != reflect.Slice {
+			raw = string(b)
+		}
+		if _, ok := field.Interface().(time.Time); ok {
+			s, _ := raw.(string)
+			if s == "" {
+				continue
+			}
+			t, err := time.Parse(sqliteTimeFormat, s)
+			if err != nil {
+				return err
+			}
+			field.Set(reflect.ValueOf(t))
+			continue
+		}
+		switch field.Kind() {
+			case reflect.String:
+				s, _ := raw.(string)
+				field.SetString(s)
+			case reflect.Bool:
+				switch b := raw.(type) {
+					case bool:
+						field.SetBool(b)
+					case int64:
+						field.SetBool(b != 0)
+				}
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				n, _ := raw.(int64)
+				field.SetInt(n)
+			case reflect.Float32, reflect.Float64:
+				switch n := raw.(type) {
+					case float64:
+						field.SetFloat(n)
+					case int64:
+						field.SetFloat(float64(n))
+				}
+			case reflect.Slice:
+				if field.Type().Elem().Kind() == reflect.Uint8 {
+					switch b := raw.(type) {
+						case []byte:
+							field.SetBytes(append([]byte{}, b...))
+						case string:
+							field.SetBytes([]byte(b))
+					}
+					continue
+				}
+				fallthrough
+			default:
+				s, _ := raw.(string)
+				if s != "" {
+					if err := json.Unmarshal([]byte(s), field.Addr().Interface()); err != nil {
+						return err
+					}
+				}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+/*
+ * SQLite backend against an in-memory database
+ */
+
+func openSQLite(t *testing.T) (*SQLiteStore, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLiteStore(db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	s, db := openSQLite(t)
+	defer db.Close()
+	// Migrating an up to date schema again changes nothing
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var version, runs int
+	if err := db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_version`).Scan(&version, &runs); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) || runs != len(sqliteMigrations) {
+		t.Errorf("got version %d after %d migrations, want %d", version, runs, len(sqliteMigrations))
+	}
+	// Every model has a table with a column per field
+	for _, m := range models {
+		fields := sqliteFields(reflect.TypeOf(m).Elem())
+		if _, err := db.Exec(`SELECT id, key_name, ` + sqliteColumns(fields) + ` FROM ` + m.Type() + ` LIMIT 0`); err != nil {
+			t.Errorf("%s: %v", m.Type(), err)
+		}
+	}
+}
+
+func TestSQLiteNamedUpsert(t *testing.T) {
+	s, db := openSQLite(t)
+	defer db.Close()
+	key := s.NamedKey("Status", "github-42")
+	var ids []int64
+	for _, heading := range []string{"pushed to autosite-go", "pushed to autosite-go (edited)"} {
+		if got, err := s.Put("Status", key, &Status{Name: "github", OriginalId: 42, Heading: heading}); err != nil || got != key {
+			t.Fatalf("put: got key %q, error %v", got, err)
+		}
+		var id int64
+		if err := db.QueryRow(`SELECT id FROM Status WHERE key_name = ?`, "github-42").Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	var stored []Status
+	keys, err := s.GetAll(NewQuery("Status"), &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key || stored[0].Heading != "pushed to autosite-go (edited)" {
+		t.Errorf("got %v %+v, want one updated status under %s", keys, stored, key)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("row id changed from %d to %d", ids[0], ids[1])
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2 * 60 * 60)
+	tests := []struct {
+		name string
+		key string
+		src Model
+		dst Model
+		want Model
+	}{
+		{
+			name: "post with tags and local date",
+			src: &Post{Title: "Hello", Name: "hello", Tags: "go, sqlite", Date: time.Date(2014, 3, 20, 14, 0, 0, 123456789, berlin), Body: []byte("<p>Hi</p>"), Timeline: true},
+			dst: &Post{},
+			want: &Post{Title: "Hello", Name: "hello", Tags: "go, sqlite", Date: time.Date(2014, 3, 20, 12, 0, 0, 123456789, time.UTC), Body: []byte("<p>Hi</p>"), Timeline: true},
+		},
+		{
+			name: "page without schedule",
+			src: &Page{Title: "About", Name: "about", Published: true, Format: "markdown", Source: []byte("# About")},
+			dst: &Page{},
+			want: &Page{Title: "About", Name: "about", Published: true, Format: "markdown", Source: []byte("# About")},
+		},
+		{
+			name: "status under named key",
+			key: "Status/@feed-7",
+			src: &Status{Name: "feed", OriginalId: 7, Guid: "urn:7", Created: time.Date(2014, 3, 20, 12, 0, 0, 0, time.UTC)},
+			dst: &Status{},
+			want: &Status{Name: "feed", OriginalId: 7, Guid: "urn:7", Created: time.Date(2014, 3, 20, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "account high-water mark",
+			src: &Account{Name: "feed-blog", BaseUrl: "https://example.com/feed", LatestId: 1 << 62, LatestCreated: time.Date(2014, 3, 20, 12, 0, 0, 0, time.UTC), KeepArchive: true},
+			dst: &Account{},
+			want: &Account{Name: "feed-blog", BaseUrl: "https://example.com/feed", LatestId: 1 << 62, LatestCreated: time.Date(2014, 3, 20, 12, 0, 0, 0, time.UTC), KeepArchive: true},
+		},
+	}
+	s, db := openSQLite(t)
+	defer db.Close()
+	for _, tt := range tests {
+		key, err := s.Put(tt.src.Type(), tt.key, tt.src)
+		if err != nil {
+			t.Errorf("%s: put: %v", tt.name, err)
+			continue
+		}
+		if err := s.Get(key, tt.dst); err != nil {
+			t.Errorf("%s: get %s: %v", tt.name, key, err)
+			continue
+		}
+		if !reflect.DeepEqual(tt.dst, tt.want) {
+			t.Errorf("%s:\n got  %+v\n want %+v", tt.name, tt.dst, tt.want)
+		}
+	}
+}
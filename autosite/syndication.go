@@ -0,0 +1,193 @@
+/*
+    Package autosite provides a simple infrastructure for running a
+    personal website (off of the Google App Engine)
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package autosite
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+
+/*
+ * Atom and RSS feeds of the timeline (all networks or a single one)
+ */
+
+// Updates per feed
+const feedLength = 20
+
+type atomFeed struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	Id string `xml:"id"`
+	Title string `xml:"title"`
+	Updated string `xml:"updated"`
+	Author atomPerson `xml:"author"`
+	Links []atomLink `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	Uri string `xml:"uri,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomEntry struct {
+	Id string `xml:"id"`
+	Title string `xml:"title"`
+	Links []atomLink `xml:"link"`
+	Published string `xml:"published"`
+	Updated string `xml:"updated"`
+	Author *atomPerson `xml:"author,omitempty"`
+	Category atomCategory `xml:"category"`
+	Summary string `xml:"summary,omitempty"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string `xml:"version,attr"`
+	AtomNS string `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title string `xml:"title"`
+	Link string `xml:"link"`
+	Description string `xml:"description"`
+	Self rssSelfLink `xml:"atom:link"`
+	LastBuildDate string `xml:"lastBuildDate"`
+	Items []rssItem `xml:"item"`
+}
+
+type rssSelfLink struct {
+	Href string `xml:"href,attr"`
+	Rel string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool `xml:"isPermaLink,attr"`
+	Value string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title string `xml:"title"`
+	Link string `xml:"link,omitempty"`
+	Description string `xml:"description,omitempty"`
+	PubDate string `xml:"pubDate"`
+	Guid rssGuid `xml:"guid"`
+	Category string `xml:"category"`
+}
+
+// Handler: Serve latest updates as Atom or RSS feed, for all networks or the one in the URL
+func FeedHandler(w http.ResponseWriter, r *http.Request, ctx *Context) {
+	if ctx.Method != "GET" {
+		return
+	}
+	network := ctx.Vars["network"]
+	q := NewQuery("Status").Order("-Created").Limit(feedLength)
+	if network != "" {
+		if AccountProvider(network) == nil && network != postNetwork {
+			http.NotFound(w, r)
+			return
+		}
+		q = q.Filter("Name =", network)
+	}
+	var updates []*Status
+	if _, err := ctx.Store.GetAll(q, &updates); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var site Site
+	Get(ctx, &site)
+	base := siteUrl(r)
+	title := site.SiteTitle
+	if title == "" {
+		title = r.Host
+	}
+	if network != "" {
+		title += " - " + (&Status{Name: network}).NameTitle()
+	}
+	updated := time.Now()
+	if len(updates) > 0 {
+		updated = updates[0].Created
+	}
+	self := base.ResolveReference(&url.URL{Path: r.URL.Path}).String()
+	home := base.String() + "/"
+	var doc interface{}
+	switch ctx.Vars["format"] {
+		case "atom":
+			feed := atomFeed{Id: self, Title: title, Updated: updated.UTC().Format(time.RFC3339), Author: atomPerson{Name: title, Uri: home}}
+			feed.Links = []atomLink{{Href: home, Rel: "alternate", Type: "text/html"}, {Href: self, Rel: "self", Type: "application/atom+xml"}}
+			for _, s := range updates {
+				entry := atomEntry{Id: statusGuid(base, s), Title: s.Heading, Published: s.Created.UTC().Format(time.RFC3339), Updated: s.Created.UTC().Format(time.RFC3339), Category: atomCategory{Term: s.Name, Label: s.NameTitle()}, Summary: s.Content}
+				if entry.Title == "" {
+					entry.Title = s.NameTitle()
+				}
+				entry.Links = []atomLink{{Href: absoluteUrl(base, s.Link, home), Rel: "alternate"}}
+				if s.User != "" {
+					entry.Author = &atomPerson{Name: s.User, Uri: absoluteUrl(base, s.UserUrl, "")}
+				}
+				feed.Entries = append(feed.Entries, entry)
+			}
+			w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+			doc = feed
+		case "rss":
+			channel := rssChannel{Title: title, Link: home, Description: "Latest updates from " + title, LastBuildDate: updated.Format(time.RFC1123Z)}
+			channel.Self = rssSelfLink{Href: self, Rel: "self", Type: "application/rss+xml"}
+			for _, s := range updates {
+				item := rssItem{Title: s.Heading, Link: absoluteUrl(base, s.Link, ""), Description: s.Content, PubDate: s.Created.Format(time.RFC1123Z), Guid: rssGuid{Value: statusGuid(base, s)}, Category: s.NameTitle()}
+				if item.Title == "" {
+					item.Title = s.NameTitle()
+				}
+				channel.Items = append(channel.Items, item)
+			}
+			w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			doc = rssFeed{Version: "2.0", AtomNS: "http://www.w3.org/2005/Atom", Channel: channel}
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+}
+
+// Helper: Return scheme and host the site was requested at
+func siteUrl(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+// Helper: Resolve link (possibly relative, like those of blog posts) against base URL, or return fallback for none
+func absoluteUrl(base *url.URL, link string, fallback string) string {
+	if link == "" {
+		return fallback
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return fallback
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// Helper: Return permanent, unique id of update (a tag URI, as its link may be missing or shared)
+func statusGuid(base *url.URL, s *Status) string {
+	name := s.KeyName()
+	if name == "" {
+		name = s.Name + "-" + strconv.FormatInt(feedId(s.Link + s.Heading + s.Created.String()), 10)
+	}
+	return "tag:" + base.Hostname() + "," + s.Created.UTC().Format("2006-01-02") + ":" + name
+}
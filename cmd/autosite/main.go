@@ -0,0 +1,120 @@
+//go:build !appengine
+// +build !appengine
+
+/*
+    Command autosite serves an autosite website from a plain net/http server,
+    for running outside of the Google App Engine (e.g. on a VPS or in a container).
+    Set AUTOSITE_ADMIN=name:password to create (or reset) an admin user on startup,
+    and AUTOSITE_SESSION_KEYS to a comma-separated list of base64 "hashkey:encryptionkey"
+    pairs (newest first) to sign session cookies with. Keys are generated otherwise.
+    Set AUTOSITE_MASTER_KEYS to a comma-separated list of base64 32 byte keys (newest
+    first) to encrypt account secrets at rest.
+
+    Created by Ulf Möhring <ulf@moehring.me>
+*/
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/paceline/autosite-go/autosite"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	addr = flag.String("addr", "localhost:8080", "address to listen on")
+	root = flag.String("root", ".", "directory containing the templates and static folders")
+	backend = flag.String("store", "file", "storage backend, either file (JSON) or sqlite")
+	data = flag.String("data", "autosite.json", "file to store site data in")
+	secure = flag.Bool("secure-cookies", false, "only send session cookies over HTTPS")
+	refresh = flag.Duration("refresh", 10 * time.Minute, "interval for refreshing the timeline and publishing scheduled pages (0 to disable)")
+)
+
+func main() {
+	flag.Parse()
+	if err := os.Chdir(*root); err != nil {
+		log.Fatal(err)
+	}
+
+	// Storage and outgoing requests
+	storage, err := openStore(*backend, *data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	autosite.Storage = func(r *http.Request) autosite.Store {
+		return storage
+	}
+	if admin := os.Getenv("AUTOSITE_ADMIN"); admin != "" {
+		parts := strings.SplitN(admin, ":", 2)
+		if len(parts) != 2 {
+			log.Fatal("AUTOSITE_ADMIN must be given as name:password")
+		}
+		if err := autosite.SetPassword(storage, parts[0], parts[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config := os.Getenv("AUTOSITE_SESSION_KEYS"); config != "" {
+		keys, err := autosite.ParseSessionKeys(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		autosite.SessionKeys = keys
+	}
+	if config := os.Getenv("AUTOSITE_MASTER_KEYS"); config != "" {
+		keys, err := autosite.ParseMasterKeys(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		autosite.MasterKeys = keys
+	}
+	autosite.SecureCookies = *secure
+	autosite.HTTPClient = func(r *http.Request) *http.Client {
+		return &http.Client{Timeout: 30 * time.Second}
+	}
+
+	// Replacement for cron.yaml
+	if *refresh > 0 {
+		go func() {
+			for range time.Tick(*refresh) {
+				r, _ := http.NewRequest("GET", "http://" + *addr + "/manage/refresh", nil)
+				w := httptest.NewRecorder()
+				autosite.Handler(autosite.Refresh).ServeHTTP(w, r)
+				log.Printf("%s", w.Body.String())
+				r, _ = http.NewRequest("GET", "http://" + *addr + "/manage/publish", nil)
+				w = httptest.NewRecorder()
+				autosite.Handler(autosite.PublishScheduled).ServeHTTP(w, r)
+				log.Printf("%s", w.Body.String())
+			}
+		}()
+	}
+
+	// Static files (static_dir in app.yaml) and site
+	http.Handle("/static/", http.FileServer(http.Dir(".")))
+	http.Handle("/", autosite.NewRouter())
+	log.Printf("Serving autosite on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// Open storage backend of given type
+func openStore(backend, path string) (autosite.Store, error) {
+	switch backend {
+		case "file":
+			return autosite.NewFileStore(path)
+		case "sqlite":
+			// Wait for other processes holding the lock (e.g. a backup) instead of failing right away
+			db, err := sql.Open("sqlite3", path + "?_busy_timeout=5000")
+			if err != nil {
+				return nil, err
+			}
+			return autosite.NewSQLiteStore(db)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
@@ -1,5 +1,10 @@
 $(window).ready(function(){
   
+	// Send anti-forgery token with every AJAX call
+	$.ajaxSetup({
+		headers: { 'X-CSRF-Token': $('meta[name="csrf-token"]').attr('content') }
+	});
+	
 	// Do menu highlighting
 	$("#menu > a").each(function() {
 		var path = window.location.pathname.split("/");
@@ -38,6 +43,14 @@ $(window).ready(function(){
 		}
 	});
 	
+	// Links posting a form (with the anti-forgery token) instead of just being followed
+	$('a[data-method="post"]').click(function(event) {
+		event.preventDefault();
+		$('<form method="post"></form>').attr('action', $(this).attr('href'))
+			.append($('<input name="_csrf" type="hidden" />').val($('meta[name="csrf-token"]').attr('content')))
+			.appendTo('body').submit();
+	});
+	
 	// Helper for upcasing just the first char
 	function toTitle(word) {
 		return word.charAt(0).toUpperCase() + word.slice(1)